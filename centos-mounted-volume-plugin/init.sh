@@ -1,8 +1,27 @@
 #!/bin/sh -e
-echo PACKAGES=${PACKAGES} >> /pluginenv
-echo MOUNT_OPTIONS=${MOUNT_OPTIONS} >> /pluginenv
-echo MOUNT_TYPE=${MOUNT_TYPE} >> /pluginenv
-echo http_proxy=${http_proxy} >> /pluginenv
+# pluginenv writes the variables to the EnvironmentFile of the plugin service.
+# The values are double quoted with \ " ` and $ escaped so systemd reads them
+# back unchanged.
+pluginenv() {
+  for name in "$@"
+  do
+    eval "value=\${${name}}"
+    printf '%s="%s"\n' "${name}" "$(printf '%s' "${value}" | sed 's/[\\"`$]/\\&/g')" >> /pluginenv
+  done
+}
+pluginenv PACKAGES \
+  MOUNT_OPTIONS \
+  MOUNT_TYPE \
+  http_proxy \
+  PREMOUNT_HOOK \
+  PREMOUNT_HOOK_TIMEOUT \
+  PREMOUNT_HOOK_FAILURE \
+  POSTMOUNT_HOOK \
+  POSTMOUNT_HOOK_TIMEOUT \
+  POSTMOUNT_HOOK_FAILURE \
+  PREUNMOUNT_HOOK \
+  PREUNMOUNT_HOOK_TIMEOUT \
+  PREUNMOUNT_HOOK_FAILURE
 mkdir -p /dockerplugins
 if [ -e /run/docker/plugins ]
 then
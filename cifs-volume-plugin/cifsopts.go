@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/trajano/docker-volume-plugins/mounted-volume"
+)
+
+// defaultForbiddenCifsopts are the options that may not be specified in
+// driver_opts.cifsopts as they would expose the credentials in the volume
+// definition.
+const defaultForbiddenCifsopts = "username,user,password,pass,credentials"
+
+// shareCifsopts returns the contents of the .cifsopts file for the volume
+// found using the same order as the credential file.  Each line may contain
+// comma separated options, blank lines and lines starting with # are
+// ignored.
+func (p *cifsDriver) shareCifsopts(pathList []string) string {
+	file := p.lookupFile(pathList, ".cifsopts")
+	if file == "" {
+		return ""
+	}
+	var opts []string
+	for _, line := range strings.Split(string(p.credential(file).content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			opts = append(opts, line)
+		}
+	}
+	return strings.Join(opts, ",")
+}
+
+// mergedCifsopts merges DEFAULT_CIFSOPTS, the share options file and
+// driver_opts.cifsopts with the latter taking precedence.
+func (p *cifsDriver) mergedCifsopts(req *volume.CreateRequest) (mountedvolume.OptionList, error) {
+	pathList := strings.Split(req.Name, "/")
+	if name, err := shareNameFromRequest(req); err == nil {
+		pathList = name.pathList()
+	}
+	merged, err := mountedvolume.MergeOptionLists(p.defaultCifsopts, p.shareCifsopts(pathList), req.Options["cifsopts"])
+	if err != nil {
+		return nil, fmt.Errorf("unable to merge the options for %s: %s", req.Name, err)
+	}
+	return merged, nil
+}
+
+// validateCifsopts rejects driver_opts.cifsopts that contain duplicate or
+// forbidden options.
+func (p *cifsDriver) validateCifsopts(cifsopts string) error {
+	opts, err := mountedvolume.ParseOptionList(cifsopts)
+	if err != nil {
+		return fmt.Errorf("invalid cifsopts: %s", err)
+	}
+	for _, opt := range opts {
+		for _, forbidden := range p.forbiddenCifsopts {
+			if !opt.Remove && strings.EqualFold(opt.Key, forbidden) {
+				return fmt.Errorf("cifsopts must not contain %s, credentials are provided by the plugin", opt.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// RedactArgs masks the passwords in the options shown in the volume status.
+func (p *cifsDriver) RedactArgs(args []string) []string {
+	redacted := append([]string{}, args...)
+	for i := 0; i < len(redacted)-1; i++ {
+		if redacted[i] != "-o" {
+			continue
+		}
+		opts := strings.Split(redacted[i+1], ",")
+		for j, opt := range opts {
+			key := strings.ToLower(strings.SplitN(opt, "=", 2)[0])
+			if (key == "password" || key == "pass") && strings.Contains(opt, "=") {
+				opts[j] = opt[:strings.Index(opt, "=")] + "=********"
+			}
+		}
+		redacted[i+1] = strings.Join(opts, ",")
+	}
+	return redacted
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// defaultPrivatePath is a tmpfs within the plugin where the credential data
+// is written for the duration of the mount.
+const defaultPrivatePath = "/run/cifs-volume-plugin"
+
+// credentialEntry is the content of a file from the credential path along
+// with the problems found when validating it.  The modification time and
+// size are used to detect that the file has changed.
+type credentialEntry struct {
+	content  []byte
+	problems error
+	modTime  time.Time
+	size     int64
+}
+
+// credentialDirectory is where the host directory used by the directory
+// credential source is mounted.
+const credentialDirectory = "/credentials"
+
+// credentialSource provides the credential and keytab files that are looked
+// up for the volumes.
+type credentialSource interface {
+	// load returns the entries keyed by file name.  The previous entries are
+	// kept for the files that have not changed since they were loaded.
+	load(p *cifsDriver, previous map[string]*credentialEntry) map[string]*credentialEntry
+}
+
+// newCredentialSource returns the source for CREDENTIAL_SOURCE along with the
+// credential path that it uses.
+func newCredentialSource(name string, credentialPath string) (credentialSource, string) {
+	switch name {
+	case "", "file":
+		return directoryCredentialSource{}, credentialPath
+	case "env":
+		value := os.Getenv("CREDENTIALS")
+		// Keep it out of the environment of the mount commands and hooks.
+		os.Unsetenv("CREDENTIALS")
+		return envCredentialSource{value: value}, credentialPath
+	case "directory":
+		return directoryCredentialSource{}, credentialDirectory
+	default:
+		log.Printf("unknown CREDENTIAL_SOURCE %s, using file", name)
+		return directoryCredentialSource{}, credentialPath
+	}
+}
+
+// directoryCredentialSource reads all the files in the credential path.
+type directoryCredentialSource struct{}
+
+func (directoryCredentialSource) load(p *cifsDriver, previous map[string]*credentialEntry) map[string]*credentialEntry {
+	credentials := make(map[string]*credentialEntry)
+	root := p.credentialRoot()
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		log.Printf("unable to read credentials from %s: %s", p.credentialPath, err)
+		return credentials
+	}
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		file := filepath.Join(p.credentialPath, fi.Name())
+		entry, loaded := previous[fi.Name()]
+		info, err := os.Stat(filepath.Join(root, fi.Name()))
+		if err == nil && loaded && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+			credentials[fi.Name()] = entry
+			continue
+		}
+		var content []byte
+		if err == nil {
+			content, err = ioutil.ReadFile(filepath.Join(root, fi.Name()))
+		}
+		if err != nil {
+			if loaded {
+				// Symlinks to absolute paths cannot be followed once the
+				// host directories are hidden.
+				credentials[fi.Name()] = entry
+			} else {
+				log.Printf("unable to read credential file %s: %s", file, err)
+			}
+			continue
+		}
+		credentials[fi.Name()] = &credentialEntry{
+			content:  content,
+			problems: p.validateCredentialsFile(file),
+			modTime:  info.ModTime(),
+			size:     info.Size(),
+		}
+	}
+	return credentials
+}
+
+// envCredentialSource provides the default credentials from the CREDENTIALS
+// plugin setting.
+type envCredentialSource struct {
+	value string
+}
+
+func (s envCredentialSource) load(p *cifsDriver, previous map[string]*credentialEntry) map[string]*credentialEntry {
+	credentials := make(map[string]*credentialEntry)
+	if s.value == "" {
+		if previous == nil {
+			log.Printf("CREDENTIALS is not set")
+		}
+		return credentials
+	}
+	entry := &credentialEntry{content: []byte(s.value)}
+	if !strings.HasSuffix(s.value, "\n") {
+		entry.content = append(entry.content, '\n')
+	}
+	if loaded, ok := previous["default"]; ok && bytes.Equal(loaded.content, entry.content) {
+		credentials["default"] = loaded
+		return credentials
+	}
+	if strings.Contains(s.value, "\r\n") {
+		entry.problems = fmt.Errorf("CREDENTIALS has CRLF line endings")
+	}
+	credentials["default"] = entry
+	return credentials
+}
+
+// loadCredentials reads the credentials from the source into memory.  The
+// memory is locked where possible so it is not swapped out.  The file
+// hierarchy in the credential path is used if no source is set.  On the first
+// load the credential path is opened so the files can be read again when
+// they change after the host directories are hidden.
+func (p *cifsDriver) loadCredentials() {
+	source := p.credentialSource
+	if source == nil {
+		source = directoryCredentialSource{}
+	}
+	previous := p.credentials
+	if _, ok := source.(directoryCredentialSource); ok && previous == nil && p.credentialDir == nil {
+		if dir, err := os.Open(p.credentialPath); err == nil {
+			p.credentialDir = dir
+		}
+	}
+	p.credentials = source.load(p, previous)
+	for name, entry := range p.credentials {
+		if previous[name] == entry {
+			continue
+		}
+		if len(entry.content) > 0 {
+			if err := syscall.Mlock(entry.content); err != nil {
+				log.Printf("unable to lock credential file %s in memory: %s", name, err)
+			}
+		}
+		if previous != nil {
+			log.Printf("loaded credential file %s", name)
+		}
+	}
+	for name := range previous {
+		if _, ok := p.credentials[name]; !ok {
+			log.Printf("credential file %s was removed", name)
+		}
+	}
+	if previous == nil {
+		log.Printf("loaded %d credential files from %s", len(p.credentials), p.credentialPath)
+	}
+}
+
+// reloadCredentials picks up credential files that were added, changed or
+// removed since they were loaded.  This must be called while holding the
+// lock.
+func (p *cifsDriver) reloadCredentials() {
+	if p.credentials != nil {
+		p.loadCredentials()
+	}
+}
+
+// credentialRoot returns the directory the credential files are read from.
+// Once the credential path has been opened its files are read through the
+// open directory as the path itself is hidden.
+func (p *cifsDriver) credentialRoot() string {
+	if p.credentialDir != nil {
+		return fmt.Sprintf("/proc/self/fd/%d", p.credentialDir.Fd())
+	}
+	return p.credentialPath
+}
+
+// realPath returns the path of the file with the symlinks resolved.  It is
+// obtained from the open file so it also works through credentialRoot.
+func realPath(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return os.Readlink(fmt.Sprintf("/proc/self/fd/%d", f.Fd()))
+}
+
+// credential returns the entry for the file returned by lookupFile.
+func (p *cifsDriver) credential(file string) *credentialEntry {
+	return p.credentials[filepath.Base(file)]
+}
+
+// mountPrivatePath mounts a tmpfs accessible only by root on the private
+// path so credential data written there never reaches the disk.
+func (p *cifsDriver) mountPrivatePath() {
+	if err := os.MkdirAll(p.privatePath, 0700); err != nil {
+		log.Printf("unable to create %s: %s", p.privatePath, err)
+		return
+	}
+	if err := syscall.Mount("tmpfs", p.privatePath, "tmpfs", syscall.MS_NOEXEC|syscall.MS_NOSUID|syscall.MS_NODEV, "size=1m,mode=0700"); err != nil {
+		log.Printf("unable to mount tmpfs on %s: %s", p.privatePath, err)
+	}
+}
+
+// MountArgs writes the credential data for the volume to a file on the
+// private path that is only present while mount.cifs runs and adds it to the
+// options as credentials=.  Any credentials= referring to the credential path
+// that were stored by earlier versions of the plugin are replaced.
+func (p *cifsDriver) MountArgs(req *volume.MountRequest, args []string) ([]string, func(), error) {
+	noop := func() {}
+	cifsoptsIndex := -1
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-o" {
+			cifsoptsIndex = i + 1
+		}
+	}
+	if cifsoptsIndex == -1 {
+		return args, noop, nil
+	}
+	var cifsoptsArray []string
+	for _, opt := range strings.Split(args[cifsoptsIndex], ",") {
+		if !strings.HasPrefix(opt, "credentials="+p.credentialPath+"/") {
+			cifsoptsArray = append(cifsoptsArray, opt)
+		}
+	}
+	if isKerberos(cifsoptsArray) {
+		return args, noop, nil
+	}
+
+	credentialsFile := p.calculateCredentialsFile(pathListFromArgs(args))
+	if credentialsFile == "" {
+		log.Printf("no credential file found for %s, no implicit credential data will be passed by the plugin", req.Name)
+		return args, noop, nil
+	}
+
+	f, err := ioutil.TempFile(p.privatePath, "credentials")
+	if err != nil {
+		return nil, noop, err
+	}
+	cleanup := func() {
+		os.Remove(f.Name())
+	}
+	_, err = f.Write(p.credential(credentialsFile).content)
+	f.Close()
+	if err != nil {
+		cleanup()
+		return nil, noop, err
+	}
+
+	cifsoptsArray = append(cifsoptsArray, "credentials="+f.Name())
+	mountArgs := append([]string{}, args...)
+	mountArgs[cifsoptsIndex] = strings.Join(cifsoptsArray, ",")
+	return mountArgs, cleanup, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+)
+
+// dialectErrors are the mount.cifs errors that indicate the server did not
+// accept the negotiated SMB dialect.
+var dialectErrors = []string{
+	"error(95)",
+	"Operation not supported",
+	"error(112)",
+	"Host is down",
+}
+
+// FallbackArgs retries a mount that failed because of the SMB dialect with
+// each of the versions in VERS_FALLBACK in order.  Volumes that specify vers
+// are not retried.
+func (p *cifsDriver) FallbackArgs(args []string, output []byte) [][]string {
+	if len(p.versFallback) == 0 || hasOption(cifsoptsFromArgs(args), "vers") || !isDialectError(string(output)) {
+		return nil
+	}
+	cifsoptsIndex := -1
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-o" {
+			cifsoptsIndex = i + 1
+		}
+	}
+	if cifsoptsIndex == -1 {
+		return nil
+	}
+	var candidates [][]string
+	for _, vers := range p.versFallback {
+		candidate := append([]string{}, args...)
+		if candidate[cifsoptsIndex] == "" {
+			candidate[cifsoptsIndex] = "vers=" + vers
+		} else {
+			candidate[cifsoptsIndex] += ",vers=" + vers
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates
+}
+
+func isDialectError(output string) bool {
+	for _, e := range dialectErrors {
+		if strings.Contains(output, e) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// krb5Session holds the keytab of a volume that is mounted with Kerberos so
+// the ticket in its credential cache can be renewed for long lived mounts.
+type krb5Session struct {
+	dir       string
+	keytab    []byte
+	principal string
+	ccache    string
+	lastUsed  time.Time
+}
+
+// isKerberos returns true if the mount options request Kerberos
+// authentication.
+func isKerberos(cifsoptsArray []string) bool {
+	for _, opt := range cifsoptsArray {
+		if strings.HasPrefix(opt, "sec=krb5") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOption returns true if the option key is present in the options.
+func hasOption(cifsoptsArray []string, key string) bool {
+	for _, opt := range cifsoptsArray {
+		if opt == key || strings.HasPrefix(opt, key+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// cifsoptsFromArgs extracts the options from the mount arguments.
+func cifsoptsFromArgs(args []string) []string {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-o" {
+			return strings.Split(args[i+1], ",")
+		}
+	}
+	return nil
+}
+
+// MountEnv obtains a ticket for volumes that are mounted with sec=krb5 and
+// points cifs.upcall to its credential cache using KRB5CCNAME.
+func (p *cifsDriver) MountEnv(req *volume.MountRequest, args []string) ([]string, error) {
+	if !isKerberos(cifsoptsFromArgs(args)) {
+		return nil, nil
+	}
+	s, err := p.krb5Session(req.Name, pathListFromArgs(args))
+	if err != nil {
+		return nil, err
+	}
+	return []string{"KRB5CCNAME=FILE:" + s.ccache}, nil
+}
+
+// krb5Session obtains a ticket for the volume and starts renewing it if it
+// is not already being renewed.  The path elements are used to look up the
+// keytab.
+func (p *cifsDriver) krb5Session(volumeName string, pathList []string) (*krb5Session, error) {
+	p.krb5m.Lock()
+	defer p.krb5m.Unlock()
+
+	if s, ok := p.krb5Sessions[volumeName]; ok {
+		s.lastUsed = time.Now()
+		// The keytab may have been replaced since the session started.
+		if keytabFile := p.calculateKeytabFile(pathList); keytabFile != "" {
+			s.keytab = p.credential(keytabFile).content
+		}
+		return s, s.kinit()
+	}
+
+	keytabFile := p.calculateKeytabFile(pathList)
+	if keytabFile == "" {
+		return nil, fmt.Errorf("no keytab found for %s in %s", volumeName, p.credentialPath)
+	}
+	s := &krb5Session{
+		dir:      p.privatePath,
+		keytab:   p.credential(keytabFile).content,
+		ccache:   ccacheFile(p.privatePath, volumeName),
+		lastUsed: time.Now(),
+	}
+	if err := s.kinit(); err != nil {
+		return nil, err
+	}
+	p.krb5Sessions[volumeName] = s
+	go p.renewKrb5(volumeName, s)
+	return s, nil
+}
+
+// ccacheFile returns the credential cache of the volume.  It is named after
+// a hash of the volume name as the sessions are per volume, volumes on the
+// same share must not remove the credential cache of each other.
+func ccacheFile(dir string, volumeName string) string {
+	sum := sha256.Sum256([]byte(volumeName))
+	return filepath.Join(dir, "krb5cc_"+hex.EncodeToString(sum[:16]))
+}
+
+// renewKrb5 periodically obtains a new ticket until the volume is no longer
+// mounted, at which point the credential cache is removed.
+func (p *cifsDriver) renewKrb5(volumeName string, s *krb5Session) {
+	ticker := time.NewTicker(p.krb5RenewInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		resp, err := p.Get(&volume.GetRequest{Name: volumeName})
+		if err != nil || resp.Volume.Status["mounted"] != true {
+			p.krb5m.Lock()
+			// A mount may have started using the session after the status
+			// was retrieved.
+			if time.Since(s.lastUsed) < p.krb5RenewInterval {
+				p.krb5m.Unlock()
+				continue
+			}
+			delete(p.krb5Sessions, volumeName)
+			p.krb5m.Unlock()
+			os.Remove(s.ccache)
+			return
+		}
+		p.krb5m.Lock()
+		if err := s.kinit(); err != nil {
+			log.Printf("unable to renew Kerberos ticket for %s: %s", volumeName, err)
+		}
+		p.krb5m.Unlock()
+	}
+}
+
+// kinit obtains a ticket from the keytab into the credential cache.  The
+// keytab is written to a temporary file that is removed once kinit is done.
+func (s *krb5Session) kinit() error {
+	keytabFile, err := ioutil.TempFile(s.dir, "keytab")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keytabFile.Name())
+	_, err = keytabFile.Write(s.keytab)
+	keytabFile.Close()
+	if err != nil {
+		return err
+	}
+
+	if s.principal == "" {
+		out, err := exec.Command("klist", "-k", keytabFile.Name()).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("unable to read keytab: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+		if s.principal = firstKeytabPrincipal(string(out)); s.principal == "" {
+			return fmt.Errorf("no principal found in keytab")
+		}
+	}
+
+	out, err := exec.Command("kinit", "-k", "-t", keytabFile.Name(), "-c", "FILE:"+s.ccache, s.principal).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("kinit for %s failed: %s: %s", s.principal, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// firstKeytabPrincipal parses the output of klist -k and returns the first
+// principal listed.
+func firstKeytabPrincipal(klistOutput string) string {
+	entries := false
+	for _, line := range strings.Split(klistOutput, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "----") {
+			entries = true
+		} else if entries && len(fields) >= 2 {
+			return fields[1]
+		}
+	}
+	return ""
+}
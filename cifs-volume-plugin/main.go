@@ -1,87 +1,320 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/trajano/docker-volume-plugins/mounted-volume"
 )
 
 type cifsDriver struct {
-	credentialPath  string
-	defaultCifsopts string
+	credentialPath    string
+	credentialPolicy  string
+	credentialSource  credentialSource
+	credentials       map[string]*credentialEntry
+	credentialDir     *os.File
+	privatePath       string
+	defaultCifsopts   string
+	forbiddenCifsopts []string
+	krb5RenewInterval time.Duration
+	versFallback      []string
+	krb5Sessions      map[string]*krb5Session
+	krb5m             *sync.Mutex
 	mountedvolume.Driver
 }
 
 func (p *cifsDriver) Validate(req *volume.CreateRequest) error {
 
+	name, err := shareNameFromRequest(req)
+	if err != nil {
+		return err
+	}
+	if cifsopts, cifsoptsInOpts := req.Options["cifsopts"]; cifsoptsInOpts {
+		if err := p.validateCifsopts(cifsopts); err != nil {
+			return err
+		}
+	}
+	if _, err := p.mergedCifsopts(req); err != nil {
+		return err
+	}
+
+	cifsoptsArray := p.cifsoptsArray(req)
+	for _, opt := range name.options() {
+		key := strings.SplitN(opt, "=", 2)[0]
+		if hasOption(cifsoptsArray, key) {
+			return fmt.Errorf("%s must not be in the options as it is derived from the share %s", key, req.Name)
+		}
+	}
+
+	pathList := name.pathList()
+	var credentialsFile string
+	if isKerberos(cifsoptsArray) {
+		credentialsFile = p.calculateKeytabFile(pathList)
+		if credentialsFile == "" {
+			return fmt.Errorf("sec=krb5 requires a keytab for %s in %s", req.Name, p.credentialPath)
+		}
+	} else {
+		credentialsFile = p.calculateCredentialsFile(pathList)
+	}
+	if credentialsFile == "" {
+		return nil
+	}
+	if err := p.credential(credentialsFile).problems; err != nil {
+		if p.credentialPolicy == "warn" {
+			log.Println(err)
+			return nil
+		}
+		return err
+	}
 	return nil
 }
 
-func (p *cifsDriver) MountOptions(req *volume.CreateRequest) []string {
+// cifsoptsArray returns the merged options with the translated ownership
+// options taking precedence.  Options that cannot be merged are reported by
+// Validate.
+func (p *cifsDriver) cifsoptsArray(req *volume.CreateRequest) []string {
 
-	cifsopts, cifsoptsInOpts := req.Options["cifsopts"]
+	merged, _ := p.mergedCifsopts(req)
+	ownership, _ := mountedvolume.ParseOptionList(strings.Join(ownershipOptions(req.Options), ","))
+	return merged.Merge(ownership).Strings()
+}
 
-	var cifsoptsArray []string
-	if cifsoptsInOpts {
-		cifsoptsArray = append(cifsoptsArray, strings.Split(cifsopts, ",")...)
-	} else {
-		cifsoptsArray = append(cifsoptsArray, strings.Split(p.defaultCifsopts, ",")...)
+func (p *cifsDriver) MountOptions(req *volume.CreateRequest) []string {
+
+	// The credentials are added by MountArgs when the volume is mounted.
+	cifsoptsArray := p.cifsoptsArray(req)
+	if isKerberos(cifsoptsArray) && !hasOption(cifsoptsArray, "cruid") {
+		// The ticket is obtained on mount and the credential cache is owned
+		// by root.
+		cifsoptsArray = append(cifsoptsArray, "cruid=0")
 	}
-	mountedvolume.UnhideRoot()
-	defer mountedvolume.HideRoot()
-	credentialsFile := p.calculateCredentialsFile(strings.Split(req.Name, "/"))
-	if credentialsFile != "" {
-		cifsoptsArray = append(cifsoptsArray, "credentials="+credentialsFile)
-	} else {
-		log.Println("The credential file expected %s was not found, no implicit credential data will be passed by the plugin", credentialsFile)
+
+	name, err := shareNameFromRequest(req)
+	if err != nil {
+		// Not reachable as the name is checked by Validate.
+		return []string{"-t", "cifs", "-o", strings.Join(cifsoptsArray, ","), "//" + req.Name}
 	}
+	cifsoptsArray = append(cifsoptsArray, name.options()...)
+	return []string{"-t", "cifs", "-o", strings.Join(cifsoptsArray, ","), name.device()}
 
-	return []string{"-t", "cifs", "-o", strings.Join(cifsoptsArray, ","), "//" + req.Name}
+}
+
+// MapsOwnership indicates that the uid, gid and mode options are passed to
+// mount.cifs as the ownership of the files is determined by the client.
+func (p *cifsDriver) MapsOwnership() bool {
+	return true
+}
 
+// ownershipOptions translates the uid, gid and mode options to their
+// mount.cifs equivalents.
+func ownershipOptions(options map[string]string) []string {
+	ownership, err := mountedvolume.ParseOwnership(options)
+	if err != nil {
+		return nil
+	}
+	var opts []string
+	if ownership.UID >= 0 {
+		opts = append(opts, fmt.Sprintf("uid=%d", ownership.UID))
+	}
+	if ownership.GID >= 0 {
+		opts = append(opts, fmt.Sprintf("gid=%d", ownership.GID))
+	}
+	if ownership.Mode >= 0 {
+		opts = append(opts, fmt.Sprintf("file_mode=%04o", ownership.Mode), fmt.Sprintf("dir_mode=%04o", ownership.Mode))
+	}
+	return opts
 }
 
 func (p *cifsDriver) PreMount(req *volume.MountRequest) error {
-	mountedvolume.UnhideRoot()
 	return nil
 }
 
 func (p *cifsDriver) PostMount(req *volume.MountRequest) {
-	mountedvolume.HideRoot()
+}
+
+// ParentMountArgs mounts the share so the subpath within it can be created.
+// The subpath is either the prefixpath option or for volumes created by
+// earlier versions of the plugin part of the UNC.
+func (p *cifsDriver) ParentMountArgs(args []string) ([]string, string) {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] != "-o" {
+			continue
+		}
+		var opts []string
+		subdir := ""
+		for _, opt := range strings.Split(args[i+1], ",") {
+			if strings.HasPrefix(opt, "prefixpath=") {
+				subdir = strings.Trim(strings.TrimPrefix(opt, "prefixpath="), "/")
+			} else {
+				opts = append(opts, opt)
+			}
+		}
+		if subdir != "" {
+			parentArgs := append([]string{}, args...)
+			parentArgs[i+1] = strings.Join(opts, ",")
+			return parentArgs, subdir
+		}
+	}
+	parts := strings.SplitN(strings.TrimPrefix(args[len(args)-1], "//"), "/", 3)
+	if len(parts) < 3 {
+		return nil, ""
+	}
+	parentArgs := append([]string{}, args[:len(args)-1]...)
+	return append(parentArgs, "//"+parts[0]+"/"+parts[1]), strings.Trim(parts[2], "/")
 }
 
 func buildDriver() *cifsDriver {
-	credentialPath := os.Getenv("CREDENTIAL_PATH")
+	credentialSourceName := os.Getenv("CREDENTIAL_SOURCE")
+	credentialSource, credentialPath := newCredentialSource(credentialSourceName, os.Getenv("CREDENTIAL_PATH"))
+	credentialPolicy := os.Getenv("CREDENTIAL_POLICY")
 	defaultCifsopts := os.Getenv("DEFAULT_CIFSOPTS")
+	forbiddenCifsopts, forbiddenCifsoptsSet := os.LookupEnv("FORBIDDEN_CIFSOPTS")
+	if !forbiddenCifsoptsSet {
+		forbiddenCifsopts = defaultForbiddenCifsopts
+	}
+	krb5RenewInterval, err := time.ParseDuration(os.Getenv("KRB5_RENEW_INTERVAL"))
+	if err != nil || krb5RenewInterval <= 0 {
+		krb5RenewInterval = time.Hour
+	}
+	var versFallback []string
+	for _, vers := range strings.Split(os.Getenv("VERS_FALLBACK"), ",") {
+		if vers = strings.TrimSpace(vers); vers != "" {
+			versFallback = append(versFallback, vers)
+		}
+	}
 	d := &cifsDriver{
-		Driver:          *mountedvolume.NewDriver("mount", true, "cifs", "local"),
-		credentialPath:  credentialPath,
-		defaultCifsopts: defaultCifsopts,
+		Driver:            *mountedvolume.NewDriver("mount", true, "cifs", "local"),
+		credentialPath:    credentialPath,
+		credentialPolicy:  credentialPolicy,
+		credentialSource:  credentialSource,
+		privatePath:       defaultPrivatePath,
+		defaultCifsopts:   defaultCifsopts,
+		forbiddenCifsopts: strings.Split(forbiddenCifsopts, ","),
+		krb5RenewInterval: krb5RenewInterval,
+		versFallback:      versFallback,
+		krb5Sessions:      make(map[string]*krb5Session),
+		krb5m:             &sync.Mutex{},
 	}
 	d.Init(d)
+	d.mountPrivatePath()
+	d.loadCredentials()
 	mountedvolume.HideRoot()
+	if credentialSourceName == "directory" {
+		mountedvolume.HidePath(credentialDirectory)
+	} else {
+		// The credentials mount is only read by the directory source and
+		// defaults to the host /root.
+		syscall.Unmount(credentialDirectory, syscall.MNT_DETACH)
+	}
 	return d
 }
 
 func (p *cifsDriver) calculateCredentialsFile(pathList []string) string {
+	return p.lookupFile(pathList, "")
+}
+
+// calculateKeytabFile looks up the Kerberos keytab using the same order as
+// the credential file with a .keytab suffix.
+func (p *cifsDriver) calculateKeytabFile(pathList []string) string {
+	return p.lookupFile(pathList, ".keytab")
+}
+
+// lookupFile finds the most specific file for the path elements of the
+// volume falling back to the default file.  The credentials are reloaded
+// first so files that were added or changed since are considered.
+func (p *cifsDriver) lookupFile(pathList []string, suffix string) string {
+	p.reloadCredentials()
+	return p.findFile(pathList, suffix)
+}
 
-	credentialsFile := filepath.Join(p.credentialPath, strings.Join(pathList, "@"))
+// findFile looks up the file in the loaded credentials.
+func (p *cifsDriver) findFile(pathList []string, suffix string) string {
 
 	if len(pathList) == 0 {
-		credentialsFile = filepath.Join(p.credentialPath, "default")
-		if _, err := os.Stat(credentialsFile); err != nil {
+		if _, ok := p.credentials["default"+suffix]; !ok {
 			return ""
 		}
-		return credentialsFile
+		return filepath.Join(p.credentialPath, "default"+suffix)
 	}
 
-	if _, err := os.Stat(credentialsFile); err != nil {
-		return p.calculateCredentialsFile(pathList[:len(pathList)-1])
+	for _, name := range credentialsFileNames(pathList) {
+		if _, ok := p.credentials[name+suffix]; ok {
+			return filepath.Join(p.credentialPath, name+suffix)
+		}
 	}
-	return credentialsFile
+	return p.findFile(pathList[:len(pathList)-1], suffix)
+}
+
+// credentialsFileNames returns the file names to look for given the path
+// elements of the volume.  The elements are joined using '@' with any '@' or
+// '%' within an element percent-encoded as %40 and %25.  For backwards
+// compatibility the unescaped name is also returned if it is different.
+func credentialsFileNames(pathList []string) []string {
+	escaped := make([]string, len(pathList))
+	for i, element := range pathList {
+		escaped[i] = strings.Replace(strings.Replace(element, "%", "%25", -1), "@", "%40", -1)
+	}
+	name := strings.Join(escaped, "@")
+	legacyName := strings.Join(pathList, "@")
+	if legacyName != name {
+		return []string{name, legacyName}
+	}
+	return []string{name}
+}
+
+// validateCredentialsFile ensures the credential file is owned by root, is
+// not accessible by group or others, has LF line endings and if it is a
+// symlink that it does not point outside of the credential path.  All the
+// problems found are reported in the error.
+func (p *cifsDriver) validateCredentialsFile(credentialsFile string) error {
+	file := filepath.Join(p.credentialRoot(), filepath.Base(credentialsFile))
+	fi, err := os.Lstat(file)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := realPath(file)
+		if err != nil {
+			return err
+		}
+		base, err := realPath(p.credentialRoot())
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(target, base+string(filepath.Separator)) {
+			problems = append(problems, "is a symlink pointing outside of "+p.credentialPath)
+		}
+		if fi, err = os.Stat(file); err != nil {
+			return err
+		}
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 {
+		problems = append(problems, fmt.Sprintf("is owned by uid %d rather than root", stat.Uid))
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		problems = append(problems, fmt.Sprintf("is accessible by group or others (mode %04o)", fi.Mode().Perm()))
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(content, []byte("\r\n")) {
+		problems = append(problems, "has CRLF line endings")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("credential file %s %s", credentialsFile, strings.Join(problems, ", "))
+	}
+	return nil
 }
 
 func main() {
@@ -2,9 +2,15 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"syscall"
 	"testing"
 
+	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/trajano/docker-volume-plugins/mounted-volume"
 )
 
@@ -32,3 +38,524 @@ func TestCalculateCredentialsFile2(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestParentMountArgs(t *testing.T) {
+	d := &cifsDriver{}
+	parentArgs, subdir := d.ParentMountArgs([]string{"-t", "cifs", "-o", "vers=3.02", "//host/share/sub/path"})
+	if !reflect.DeepEqual(parentArgs, []string{"-t", "cifs", "-o", "vers=3.02", "//host/share"}) || subdir != "sub/path" {
+		t.Errorf("unexpected %v %s", parentArgs, subdir)
+	}
+	parentArgs, subdir = d.ParentMountArgs([]string{"-t", "cifs", "-o", "vers=3.02,prefixpath=sub/path,port=1445", "//host/share"})
+	if !reflect.DeepEqual(parentArgs, []string{"-t", "cifs", "-o", "vers=3.02,port=1445", "//host/share"}) || subdir != "sub/path" {
+		t.Errorf("unexpected %v %s", parentArgs, subdir)
+	}
+	if _, subdir := d.ParentMountArgs([]string{"-t", "cifs", "-o", "vers=3.02", "//host/share"}); subdir != "" {
+		t.Errorf("did not expect a subdirectory for a share")
+	}
+}
+
+func TestOwnershipOptions(t *testing.T) {
+	opts := ownershipOptions(map[string]string{"uid": "1000", "gid": "1000", "mode": "775"})
+	expected := []string{"uid=1000", "gid=1000", "file_mode=0775", "dir_mode=0775"}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Errorf("%v didn't match expected %v", opts, expected)
+	}
+}
+
+func TestValidateCredentialsFile(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("credential files are expected to be owned by root")
+	}
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	d := &cifsDriver{credentialPath: dir}
+	write := func(name string, content string, mode os.FileMode) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(file, mode); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	tests := []struct {
+		file    string
+		problem string
+	}{
+		{write("secure", "username=u\npassword=p\n", 0600), ""},
+		{write("world", "username=u\npassword=p\n", 0644), "accessible by group or others"},
+		{write("crlf", "username=u\r\npassword=p\r\n", 0600), "CRLF"},
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("username=u\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dir, "escape"))
+	os.Symlink(filepath.Join(dir, "secure"), filepath.Join(dir, "inside"))
+	tests = append(tests, []struct {
+		file    string
+		problem string
+	}{
+		{filepath.Join(dir, "escape"), "symlink pointing outside"},
+		{filepath.Join(dir, "inside"), ""},
+	}...)
+
+	for _, test := range tests {
+		err := d.validateCredentialsFile(test.file)
+		if test.problem == "" && err != nil {
+			t.Errorf("%s: unexpected error %s", test.file, err)
+		} else if test.problem != "" && (err == nil || !strings.Contains(err.Error(), test.problem)) {
+			t.Errorf("%s: expected %q got %v", test.file, test.problem, err)
+		}
+	}
+}
+
+func TestCredentialsFileNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected []string
+	}{
+		{"host/share", []string{"host@share"}},
+		{"host/share/sub/path", []string{"host@share@sub@path"}},
+		{"user@host/share", []string{"user%40host@share", "user@host@share"}},
+		{"host/share@2/sub", []string{"host@share%402@sub", "host@share@2@sub"}},
+		{"host/share/a@/b", []string{"host@share@a%40@b", "host@share@a@@b"}},
+		{"host/share/a/@b", []string{"host@share@a@%40b", "host@share@a@@b"}},
+		{"host/100%/sub", []string{"host@100%25@sub", "host@100%@sub"}},
+		{"host/my share/sub dir", []string{"host@my share@sub dir"}},
+		{"hôte/partagé/日本", []string{"hôte@partagé@日本"}},
+	}
+	for _, test := range tests {
+		names := credentialsFileNames(strings.Split(test.name, "/"))
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%s: %v didn't match expected %v", test.name, names, test.expected)
+		}
+	}
+}
+
+func TestCalculateCredentialsFileLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"default", "host", "host@my share", "user%40host@share", "legacy@host@share", "hôte@partagé"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("username=u\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := &cifsDriver{credentialPath: dir}
+	d.loadCredentials()
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"host/share", "host"},
+		{"host/my share/sub", "host@my share"},
+		{"user@host/share/sub", "user%40host@share"},
+		{"legacy@host/share", "legacy@host@share"},
+		{"hôte/partagé/日本", "hôte@partagé"},
+		{"other/share", "default"},
+	}
+	for _, test := range tests {
+		file := d.calculateCredentialsFile(strings.Split(test.name, "/"))
+		if file != filepath.Join(dir, test.expected) {
+			t.Errorf("%s: expected %s got %s", test.name, test.expected, file)
+		}
+	}
+}
+
+func TestReloadCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "host@share"), []byte("username=u\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := &cifsDriver{credentialPath: dir}
+	d.loadCredentials()
+	if os.Geteuid() == 0 {
+		// Hide the credential path the same way as /root.
+		if err := syscall.Mount("tmpfs", dir, "tmpfs", 0, "size=1m"); err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Unmount(dir, 0)
+	}
+
+	write := func(name string, content string) {
+		if err := ioutil.WriteFile(filepath.Join(d.credentialRoot(), name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("other", "username=o\n")
+	write("host@share", "username=rotated\n")
+	if file := d.calculateCredentialsFile([]string{"other", "share"}); file != filepath.Join(dir, "other") {
+		t.Errorf("expected the added file to be used: %s", file)
+	}
+	if content := d.credential(d.calculateCredentialsFile([]string{"host", "share"})).content; string(content) != "username=rotated\n" {
+		t.Errorf("expected the changed file to be reloaded: %q", content)
+	}
+	if err := os.Remove(filepath.Join(d.credentialRoot(), "other")); err != nil {
+		t.Fatal(err)
+	}
+	if file := d.calculateCredentialsFile([]string{"other", "share"}); file != "" {
+		t.Errorf("expected the removed file to be ignored: %s", file)
+	}
+}
+
+func TestKerberosOptions(t *testing.T) {
+	if !isKerberos([]string{"vers=3.02", "sec=krb5i"}) {
+		t.Error("expected sec=krb5i to be Kerberos")
+	}
+	if isKerberos([]string{"vers=3.02", "sec=ntlmssp"}) {
+		t.Error("did not expect sec=ntlmssp to be Kerberos")
+	}
+	if !hasOption([]string{"sec=krb5", "cruid=1000"}, "cruid") || hasOption([]string{"sec=krb5"}, "cruid") {
+		t.Error("unexpected hasOption result")
+	}
+	opts := cifsoptsFromArgs([]string{"-t", "cifs", "-o", "sec=krb5,cruid=0", "//host/share"})
+	if !reflect.DeepEqual(opts, []string{"sec=krb5", "cruid=0"}) {
+		t.Errorf("unexpected %v", opts)
+	}
+}
+
+func TestFirstKeytabPrincipal(t *testing.T) {
+	output := `Keytab name: FILE:/root/credentials/host@share.keytab
+KVNO Principal
+---- --------------------------------------------------------------------------
+   2 svc-docker@EXAMPLE.COM
+   2 svc-docker@EXAMPLE.COM
+`
+	if principal := firstKeytabPrincipal(output); principal != "svc-docker@EXAMPLE.COM" {
+		t.Errorf("unexpected principal %s", principal)
+	}
+	if principal := firstKeytabPrincipal("Keytab name: FILE:/tmp/empty\n"); principal != "" {
+		t.Errorf("unexpected principal %s", principal)
+	}
+}
+
+func TestCalculateKeytabFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"host@share", "default.keytab"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := &cifsDriver{credentialPath: dir}
+	d.loadCredentials()
+	if file := d.calculateKeytabFile(strings.Split("host/share", "/")); file != filepath.Join(dir, "default.keytab") {
+		t.Errorf("unexpected keytab %s", file)
+	}
+}
+
+func TestMountArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	privatePath, err := ioutil.TempDir("", "private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(privatePath)
+	if err := ioutil.WriteFile(filepath.Join(dir, "host@share"), []byte("username=u\npassword=p\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := &cifsDriver{credentialPath: dir, privatePath: privatePath}
+	d.loadCredentials()
+
+	stored := []string{"-t", "cifs", "-o", "vers=3.02,credentials=" + dir + "/host@share", "//host/share"}
+	args, cleanup, err := d.MountArgs(&volume.MountRequest{Name: "host/share", ID: "abc"}, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := strings.Split(args[3], ",")
+	if len(opts) != 2 || opts[0] != "vers=3.02" || !strings.HasPrefix(opts[1], "credentials="+privatePath+"/") {
+		t.Fatalf("unexpected options %v", opts)
+	}
+	credentialsFile := strings.TrimPrefix(opts[1], "credentials=")
+	if content, err := ioutil.ReadFile(credentialsFile); err != nil || string(content) != "username=u\npassword=p\n" {
+		t.Errorf("unexpected credential file content %q %v", content, err)
+	}
+	if stored[3] != "vers=3.02,credentials="+dir+"/host@share" {
+		t.Error("the stored arguments were modified")
+	}
+	cleanup()
+	if _, err := os.Stat(credentialsFile); !os.IsNotExist(err) {
+		t.Error("expected the credential file to be removed")
+	}
+
+	args, _, err = d.MountArgs(&volume.MountRequest{Name: "other/share", ID: "abc"}, []string{"-t", "cifs", "-o", "vers=3.02", "//other/share"})
+	if err != nil || args[3] != "vers=3.02" {
+		t.Errorf("did not expect credentials to be added %v %v", args, err)
+	}
+}
+
+func TestValidateCifsopts(t *testing.T) {
+	d := &cifsDriver{forbiddenCifsopts: strings.Split(defaultForbiddenCifsopts, ",")}
+	tests := []struct {
+		cifsopts string
+		valid    bool
+	}{
+		{"vers=3.02,mfsymlinks,file_mode=0666,dir_mode=0777", true},
+		{"", true},
+		{"vers=3.02,password=secret", false},
+		{"vers=3.02,PASS=secret", false},
+		{"username=me", false},
+		{"credentials=/some/path", false},
+		{"vers=3.02,mfsymlinks,vers=2.1", false},
+		{"mfsymlinks,MFSYMLINKS", false},
+		{"-mfsymlinks", true},
+		{"-vers=3.02", false},
+	}
+	for _, test := range tests {
+		err := d.validateCifsopts(test.cifsopts)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.cifsopts, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.cifsopts)
+		}
+	}
+
+	d.forbiddenCifsopts = []string{""}
+	if err := d.validateCifsopts("username=me"); err != nil {
+		t.Errorf("expected username to be allowed when nothing is forbidden: %s", err)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	d := &cifsDriver{}
+	args := []string{"-t", "cifs", "-o", "username=me,password=secret,pass=x,vers=3.02", "//host/share"}
+	redacted := d.RedactArgs(args)
+	expected := []string{"-t", "cifs", "-o", "username=me,password=********,pass=********,vers=3.02", "//host/share"}
+	if !reflect.DeepEqual(redacted, expected) {
+		t.Errorf("%v didn't match expected %v", redacted, expected)
+	}
+	if args[3] != "username=me,password=secret,pass=x,vers=3.02" {
+		t.Error("the arguments were modified")
+	}
+}
+
+func TestFallbackArgs(t *testing.T) {
+	d := &cifsDriver{versFallback: []string{"3.1.1", "2.1"}}
+	args := []string{"-t", "cifs", "-o", "mfsymlinks", "//host/share"}
+	output := []byte("mount error(95): Operation not supported")
+	candidates := d.FallbackArgs(args, output)
+	expected := [][]string{
+		{"-t", "cifs", "-o", "mfsymlinks,vers=3.1.1", "//host/share"},
+		{"-t", "cifs", "-o", "mfsymlinks,vers=2.1", "//host/share"},
+	}
+	if !reflect.DeepEqual(candidates, expected) {
+		t.Errorf("%v didn't match expected %v", candidates, expected)
+	}
+	if args[3] != "mfsymlinks" {
+		t.Error("the arguments were modified")
+	}
+
+	candidates = d.FallbackArgs([]string{"-t", "cifs", "-o", "", "//host/share"}, []byte("mount error(112): Host is down"))
+	if len(candidates) != 2 || candidates[0][3] != "vers=3.1.1" {
+		t.Errorf("unexpected candidates %v", candidates)
+	}
+	if candidates := d.FallbackArgs([]string{"-t", "cifs", "-o", "vers=3.02", "//host/share"}, output); candidates != nil {
+		t.Errorf("expected no fallback when vers is specified: %v", candidates)
+	}
+	if candidates := d.FallbackArgs(args, []byte("mount error(13): Permission denied")); candidates != nil {
+		t.Errorf("expected no fallback for other errors: %v", candidates)
+	}
+	d.versFallback = nil
+	if candidates := d.FallbackArgs(args, output); candidates != nil {
+		t.Errorf("expected no fallback when VERS_FALLBACK is not set: %v", candidates)
+	}
+}
+
+func TestShareCifsopts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"nas@share.cifsopts": "# NAS options\nvers=2.1,nobrl\n\nnoperm\n",
+		"default.cifsopts":   "vers=3.02",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := &cifsDriver{credentialPath: dir, defaultCifsopts: "vers=3.1.1,mfsymlinks"}
+	d.loadCredentials()
+
+	tests := []struct {
+		name     string
+		cifsopts string
+		expected string
+	}{
+		{"nas/share/sub", "", "vers=2.1,mfsymlinks,nobrl,noperm"},
+		{"nas/share", "vers=3.0", "vers=3.0,mfsymlinks,nobrl,noperm"},
+		{"windows/share", "", "vers=3.02,mfsymlinks"},
+		{"windows/share", "-mfsymlinks,nobrl", "vers=3.02,nobrl"},
+	}
+	for _, test := range tests {
+		req := &volume.CreateRequest{Name: test.name, Options: map[string]string{}}
+		if test.cifsopts != "" {
+			req.Options["cifsopts"] = test.cifsopts
+		}
+		if opts := strings.Join(d.cifsoptsArray(req), ","); opts != test.expected {
+			t.Errorf("%s: %s didn't match expected %s", test.name, opts, test.expected)
+		}
+	}
+}
+
+func TestEnvCredentialSource(t *testing.T) {
+	d := &cifsDriver{
+		credentialPath:   "/root/credentials",
+		credentialSource: envCredentialSource{value: "username=u\npassword=p"},
+	}
+	d.loadCredentials()
+	credentialsFile := d.calculateCredentialsFile([]string{"host", "share"})
+	if credentialsFile != "/root/credentials/default" {
+		t.Fatalf("unexpected credential file %s", credentialsFile)
+	}
+	entry := d.credential(credentialsFile)
+	if string(entry.content) != "username=u\npassword=p\n" || entry.problems != nil {
+		t.Errorf("unexpected entry %q %v", entry.content, entry.problems)
+	}
+
+	d.credentialSource = envCredentialSource{value: "username=u\r\npassword=p\r\n"}
+	d.loadCredentials()
+	if d.credential(d.calculateCredentialsFile([]string{"host"})).problems == nil {
+		t.Error("expected CRLF line endings to be a problem")
+	}
+
+	d.credentialSource = envCredentialSource{}
+	d.loadCredentials()
+	if credentialsFile := d.calculateCredentialsFile([]string{"host"}); credentialsFile != "" {
+		t.Errorf("expected no credentials when CREDENTIALS is empty: %s", credentialsFile)
+	}
+}
+
+func TestNewCredentialSource(t *testing.T) {
+	os.Setenv("CREDENTIALS", "username=u")
+	defer os.Unsetenv("CREDENTIALS")
+	tests := []struct {
+		name           string
+		source         credentialSource
+		credentialPath string
+	}{
+		{"", directoryCredentialSource{}, "/root/credentials"},
+		{"file", directoryCredentialSource{}, "/root/credentials"},
+		{"directory", directoryCredentialSource{}, credentialDirectory},
+		{"env", envCredentialSource{value: "username=u"}, "/root/credentials"},
+		{"bogus", directoryCredentialSource{}, "/root/credentials"},
+	}
+	for _, test := range tests {
+		source, credentialPath := newCredentialSource(test.name, "/root/credentials")
+		if !reflect.DeepEqual(source, test.source) || credentialPath != test.credentialPath {
+			t.Errorf("%s: unexpected %#v %s", test.name, source, credentialPath)
+		}
+	}
+	if _, ok := os.LookupEnv("CREDENTIALS"); ok {
+		t.Error("expected CREDENTIALS to be removed from the environment")
+	}
+}
+
+func TestParseShareName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected shareName
+		valid    bool
+	}{
+		{"host/share", shareName{host: "host", share: "share"}, true},
+		{"host:1445/share", shareName{host: "host", port: "1445", share: "share"}, true},
+		{"host/share/sub/path", shareName{host: "host", share: "share", subpath: "sub/path"}, true},
+		{"[fe80::1]:445/share/sub", shareName{host: "fe80::1", port: "445", share: "share", subpath: "sub"}, true},
+		{"fe80::1/share", shareName{host: "fe80::1", share: "share"}, true},
+		{"host", shareName{}, false},
+		{"/host/share", shareName{}, false},
+		{"host//share", shareName{}, false},
+		{"host/share/", shareName{}, false},
+		{"host/share/../other", shareName{}, false},
+		{"host/./share", shareName{}, false},
+		{"host:0/share", shareName{}, false},
+		{"host:smb/share", shareName{}, false},
+		{":445/share", shareName{}, false},
+	}
+	for _, test := range tests {
+		n, err := parseShareName(test.name)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		} else if test.valid && n != test.expected {
+			t.Errorf("%s: %#v didn't match expected %#v", test.name, n, test.expected)
+		}
+	}
+}
+
+func TestShareMountOptions(t *testing.T) {
+	d := &cifsDriver{defaultCifsopts: "vers=3.02"}
+	tests := []struct {
+		name     string
+		options  map[string]string
+		expected []string
+	}{
+		{"host/share", map[string]string{}, []string{"-t", "cifs", "-o", "vers=3.02", "//host/share"}},
+		{"host:1445/share/sub", map[string]string{}, []string{"-t", "cifs", "-o", "vers=3.02,port=1445,prefixpath=sub", "//host/share"}},
+		{"myvolume", map[string]string{"share": "[fe80::1]:445/share"}, []string{"-t", "cifs", "-o", "vers=3.02,port=445", "//[fe80::1]/share"}},
+	}
+	for _, test := range tests {
+		args := d.MountOptions(&volume.CreateRequest{Name: test.name, Options: test.options})
+		if !reflect.DeepEqual(args, test.expected) {
+			t.Errorf("%s: %v didn't match expected %v", test.name, args, test.expected)
+		}
+	}
+}
+
+func TestPathListFromArgs(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"-t", "cifs", "-o", "vers=3.02,port=1445,prefixpath=sub/path", "//host/share"}, []string{"host", "share", "sub", "path"}},
+		{[]string{"-t", "cifs", "-o", "vers=3.02", "//host/share/sub"}, []string{"host", "share", "sub"}},
+		{[]string{"-t", "cifs", "-o", "port=445", "//[fe80::1]/share"}, []string{"fe80::1", "share"}},
+	}
+	for _, test := range tests {
+		if pathList := pathListFromArgs(test.args); !reflect.DeepEqual(pathList, test.expected) {
+			t.Errorf("%v: %v didn't match expected %v", test.args, pathList, test.expected)
+		}
+	}
+}
+
+func TestCcacheFile(t *testing.T) {
+	first := ccacheFile("/run/cifs", "host/share/app1")
+	second := ccacheFile("/run/cifs", "host/share/app2")
+	if first == second {
+		t.Errorf("expected volumes on the same share to use different credential caches %s", first)
+	}
+	if first != ccacheFile("/run/cifs", "host/share/app1") {
+		t.Error("expected the credential cache of a volume to be stable")
+	}
+	if filepath.Dir(first) != "/run/cifs" || !strings.HasPrefix(filepath.Base(first), "krb5cc_") {
+		t.Errorf("unexpected credential cache %s", first)
+	}
+}
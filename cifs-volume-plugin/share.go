@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// shareName is a volume name of the form host[:port]/share[/subpath].
+type shareName struct {
+	host    string
+	port    string
+	share   string
+	subpath string
+}
+
+// parseShareName parses and validates the share specification.  An IPv6
+// host needs to be enclosed in brackets when a port is specified.
+func parseShareName(name string) (shareName, error) {
+	var n shareName
+	if strings.HasPrefix(name, "/") {
+		return n, fmt.Errorf("%s must not start with /", name)
+	}
+	segments := strings.Split(name, "/")
+	if len(segments) < 2 {
+		return n, fmt.Errorf("%s must be of the form host[:port]/share[/subpath]", name)
+	}
+	for _, segment := range segments {
+		if segment == "" {
+			return n, fmt.Errorf("%s must not contain empty path segments", name)
+		}
+		if segment == "." || segment == ".." {
+			return n, fmt.Errorf("%s must not contain %s", name, segment)
+		}
+	}
+
+	n.host = segments[0]
+	if strings.HasPrefix(n.host, "[") || strings.Count(n.host, ":") == 1 {
+		host, port, err := net.SplitHostPort(n.host)
+		if err != nil {
+			return n, fmt.Errorf("invalid host in %s: %s", name, err)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return n, fmt.Errorf("invalid port in %s: %s", name, port)
+		}
+		n.host = host
+		n.port = port
+	}
+	if n.host == "" {
+		return n, fmt.Errorf("%s must specify a host", name)
+	}
+	n.share = segments[1]
+	n.subpath = strings.Join(segments[2:], "/")
+	return n, nil
+}
+
+// shareNameFromRequest parses driver_opts.share if it is specified or the
+// volume name otherwise.
+func shareNameFromRequest(req *volume.CreateRequest) (shareName, error) {
+	if share, ok := req.Options["share"]; ok {
+		return parseShareName(share)
+	}
+	return parseShareName(req.Name)
+}
+
+// device returns the UNC for mount.cifs which does not include the port or
+// the subpath.
+func (n shareName) device() string {
+	if strings.Contains(n.host, ":") {
+		return "//[" + n.host + "]/" + n.share
+	}
+	return "//" + n.host + "/" + n.share
+}
+
+// options returns the port and prefixpath options for the name.
+func (n shareName) options() []string {
+	var opts []string
+	if n.port != "" {
+		opts = append(opts, "port="+n.port)
+	}
+	if n.subpath != "" {
+		opts = append(opts, "prefixpath="+n.subpath)
+	}
+	return opts
+}
+
+// pathList returns the path elements used to look up the credential files.
+// The port is not part of the lookup.
+func (n shareName) pathList() []string {
+	pathList := []string{n.host, n.share}
+	if n.subpath != "" {
+		pathList = append(pathList, strings.Split(n.subpath, "/")...)
+	}
+	return pathList
+}
+
+// pathListFromArgs returns the path elements used to look up the credential
+// files from the mount arguments.  Arguments stored by earlier versions of
+// the plugin have the subpath in the UNC rather than as prefixpath.
+func pathListFromArgs(args []string) []string {
+	unc := strings.TrimPrefix(args[len(args)-1], "//")
+	if strings.HasPrefix(unc, "[") {
+		if end := strings.Index(unc, "]"); end != -1 {
+			unc = unc[1:end] + unc[end+1:]
+		}
+	}
+	pathList := strings.Split(unc, "/")
+	for _, opt := range cifsoptsFromArgs(args) {
+		if strings.HasPrefix(opt, "prefixpath=") {
+			pathList = append(pathList, strings.Split(strings.Trim(strings.TrimPrefix(opt, "prefixpath="), "/"), "/")...)
+		}
+	}
+	return pathList
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/trajano/docker-volume-plugins/mounted-volume"
+)
+
+// glusterfsFlags are the glusterfs client flags that may be used in
+// driver_opts.glusteropts.  The value indicates whether the flag requires a
+// value which may be given as the next argument or after an '='.  Flags
+// that take an optional value must use the '=' form.
+var glusterfsFlags = map[string]bool{
+	"-s":                           true,
+	"--volfile-server":             true,
+	"--volfile-server-port":        true,
+	"--volfile-server-transport":   true,
+	"--volfile-id":                 true,
+	"--volfile-max-fetch-attempts": true,
+	"--subdir-mount":               true,
+	"-L":                           true,
+	"--log-level":                  true,
+	"--xlator-option":              true,
+	"--volume-name":                true,
+	"--process-name":               true,
+	"--fuse-mountopts":             true,
+	"--attribute-timeout":          true,
+	"--entry-timeout":              true,
+	"--negative-timeout":           true,
+	"--gid-timeout":                true,
+	"--direct-io-mode":             true,
+	"--reader-thread-count":        true,
+	"--lru-limit":                  true,
+	"--invalidate-limit":           true,
+	"--background-qlen":            true,
+	"--congestion-threshold":       true,
+	"--acl":                        false,
+	"--read-only":                  false,
+	"--enable-ino32":               false,
+	"--use-readdirp":               false,
+	"--fopen-keep-cache":           false,
+	"--kernel-writeback-cache":     false,
+	"--auto-invalidation":          false,
+	"--resolve-gids":               false,
+	"--selinux":                    false,
+	"--capability":                 false,
+	"--aux-gfid-mount":             false,
+	"--no-root-squash":             false,
+	"--localtime-logging":          false,
+	"--mem-accounting":             false,
+}
+
+// splitShellWords splits the string into words using the quoting rules of a
+// POSIX shell.  Single quotes preserve everything literally, within double
+// quotes a backslash only escapes $, `, ", \ and a newline.  Expansions are
+// not performed.
+func splitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) != -1 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+			inWord = true
+		case c == '\\':
+			if i+1 == len(s) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// parseGlusteropts splits driver_opts.glusteropts into arguments and checks
+// them against glusterfsFlags.  Positional arguments are rejected as the
+// mount point is added by the plugin, as is --pid-file which the plugin
+// does not manage and --log-file which it does.
+func parseGlusteropts(glusteropts string) ([]string, error) {
+	args, err := splitShellWords(glusteropts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse glusteropts: %s", err)
+	}
+	for i := 0; i < len(args); i++ {
+		flag := strings.SplitN(args[i], "=", 2)[0]
+		if flag == "-p" || flag == "--pid-file" {
+			return nil, fmt.Errorf("glusteropts must not contain %s", flag)
+		}
+		if flag == "-l" || flag == "--log-file" {
+			return nil, fmt.Errorf("glusteropts must not contain %s, the client log file is managed by the plugin", flag)
+		}
+		if !strings.HasPrefix(flag, "-") {
+			return nil, fmt.Errorf("glusteropts must not contain %s, the mount point is provided by the plugin", args[i])
+		}
+		requiresValue, ok := glusterfsFlags[flag]
+		if !ok {
+			return nil, fmt.Errorf("glusteropts contains %s which is not supported", flag)
+		}
+		value := ""
+		if requiresValue && !strings.Contains(args[i], "=") {
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("glusteropts %s requires a value", flag)
+			}
+			i++
+			value = args[i]
+		} else if requiresValue {
+			value = strings.SplitN(args[i], "=", 2)[1]
+		}
+		if flag == "--subdir-mount" {
+			if err := mountedvolume.ValidateSubdir(strings.TrimPrefix(value, "/")); err != nil {
+				return nil, fmt.Errorf("glusteropts --subdir-mount: %s", err)
+			}
+		}
+	}
+	return args, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultLogDir is where the per volume client logs are written within the
+// plugin.
+const defaultLogDir = "/var/log/glusterfs/volumes"
+
+// logTailLines is the number of lines of the client log shown in the status
+// when a mount fails.
+const logTailLines = 20
+
+// logLevels are the values accepted by the glusterfs --log-level flag.
+var logLevels = []string{"CRITICAL", "ERROR", "WARNING", "INFO", "DEBUG", "TRACE", "NONE"}
+
+// validLogLevel returns true if the level is accepted by glusterfs.
+func validLogLevel(level string) bool {
+	for _, l := range logLevels {
+		if level == l {
+			return true
+		}
+	}
+	return false
+}
+
+// logFile returns the client log file for the volume.  The name is escaped
+// so subdirectory volumes do not collide.
+func (p *gfsDriver) logFile(volumeName string) string {
+	return filepath.Join(p.logDir, url.PathEscape(volumeName)+".log")
+}
+
+// logArgs adds --log-file and --log-level to the arguments.  The log level
+// may be specified in glusteropts, a log file given by volumes created before
+// it was rejected in glusteropts is replaced.  The log file that the client
+// will write to is returned along with the arguments.
+func (p *gfsDriver) logArgs(volumeName string, args []string) ([]string, string) {
+	var mountArgs []string
+	hasLevel := false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case (args[i] == "-l" || args[i] == "--log-file") && i+1 < len(args):
+			i++
+		case strings.HasPrefix(args[i], "--log-file="):
+		case args[i] == "-L" || args[i] == "--log-level" || strings.HasPrefix(args[i], "--log-level="):
+			hasLevel = true
+			mountArgs = append(mountArgs, args[i])
+		default:
+			mountArgs = append(mountArgs, args[i])
+		}
+	}
+	logFile := p.logFile(volumeName)
+	if err := os.MkdirAll(p.logDir, 0755); err != nil {
+		log.Printf("unable to create %s: %s", p.logDir, err)
+	}
+	mountArgs = append(mountArgs, "--log-file="+logFile)
+	if !hasLevel && p.logLevel != "" {
+		mountArgs = append(mountArgs, "--log-level="+p.logLevel)
+	}
+	return mountArgs, logFile
+}
+
+// rotateLog renames the log file once it exceeds the maximum size keeping
+// the given number of older files with .1, .2 ... suffixes.  Returns true if
+// the file was rotated.
+func rotateLog(file string, maxSize int64, keep int) bool {
+	fi, err := os.Stat(file)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() < maxSize {
+		return false
+	}
+	os.Remove(file + "." + strconv.Itoa(keep))
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(file+"."+strconv.Itoa(i), file+"."+strconv.Itoa(i+1))
+	}
+	if keep > 0 {
+		if err := os.Rename(file, file+".1"); err != nil {
+			log.Printf("unable to rotate %s: %s", file, err)
+			return false
+		}
+	} else if err := os.Remove(file); err != nil {
+		log.Printf("unable to rotate %s: %s", file, err)
+		return false
+	}
+	return true
+}
+
+// rotateLogs rotates the client logs that have grown beyond the maximum size
+// and signals the glusterfs clients to reopen their log files.  The logs of
+// volumes that are being mounted are left for MountArgs to rotate so that
+// MountStatus reads the log the client wrote to.
+func (p *gfsDriver) rotateLogs() {
+	p.logm.Lock()
+	defer p.logm.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(p.logDir, "*.log"))
+	if err != nil {
+		return
+	}
+	mounting := make(map[string]bool)
+	for _, file := range p.logFiles {
+		mounting[file] = true
+	}
+	var rotated []string
+	for _, file := range files {
+		if !mounting[file] && rotateLog(file, p.logMaxSize, p.logKeep) {
+			rotated = append(rotated, file)
+		}
+	}
+	if len(rotated) > 0 {
+		signalGlusterfs(syscall.SIGHUP, rotated)
+	}
+}
+
+// rotateLogsPeriodically checks the size of the client logs at the interval.
+func (p *gfsDriver) rotateLogsPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		p.rotateLogs()
+	}
+}
+
+// signalGlusterfs sends the signal to the glusterfs client processes that
+// write to one of the log files, which reopen them on SIGHUP.  Clients that
+// were not started by the plugin are left alone.
+func signalGlusterfs(sig syscall.Signal, logFiles []string) {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		comm, err := ioutil.ReadFile(filepath.Join("/proc", dir.Name(), "comm"))
+		if err != nil || strings.TrimSpace(string(comm)) != "glusterfs" {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join("/proc", dir.Name(), "cmdline"))
+		if err != nil || !containsString(logFiles, glusterfsLogFile(strings.Split(string(cmdline), "\x00"))) {
+			continue
+		}
+		if pid, err := strconv.Atoi(dir.Name()); err == nil {
+			syscall.Kill(pid, sig)
+		}
+	}
+}
+
+// glusterfsLogFile returns the log file given in the arguments of a
+// glusterfs process.
+func glusterfsLogFile(args []string) string {
+	logFile := ""
+	for i := 0; i < len(args); i++ {
+		switch {
+		case (args[i] == "-l" || args[i] == "--log-file") && i+1 < len(args):
+			i++
+			logFile = args[i]
+		case strings.HasPrefix(args[i], "--log-file="):
+			logFile = strings.TrimPrefix(args[i], "--log-file=")
+		}
+	}
+	return logFile
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// logTail returns the last lines of the log file.
+func logTail(file string, lines int) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	const maxRead = 16 * 1024
+	partial := false
+	if fi, err := f.Stat(); err == nil && fi.Size() > maxRead {
+		if _, err := f.Seek(-maxRead, io.SeekEnd); err != nil {
+			return nil
+		}
+		partial = true
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil || len(content) == 0 {
+		return nil
+	}
+	all := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if partial && len(all) > 1 {
+		// The first line was only read in part.
+		all = all[1:]
+	}
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+	return all
+}
@@ -4,14 +4,29 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/trajano/docker-volume-plugins/mounted-volume"
 )
 
 type gfsDriver struct {
-	servers []string
+	servers      []string
+	probeTimeout time.Duration
+	probes       map[string][]string
+	logDir       string
+	logLevel     string
+	logMaxSize   int64
+	logKeep      int
+	logFiles     map[string]string
+	logm         sync.Mutex
+	gluster      glusterCLI
+	provision    provisionConfig
+	quotas       quotaCache
 	mountedvolume.Driver
 }
 
@@ -29,6 +44,16 @@ func (p *gfsDriver) Validate(req *volume.CreateRequest) error {
 	if len(p.servers) == 0 && !serversDefinedInOpts && !glusteroptsInOpts {
 		return fmt.Errorf("One of SERVERS, driver_opts.servers or driver_opts.glusteropts must be specified")
 	}
+	if glusteroptsInOpts {
+		if _, err := parseGlusteropts(req.Options["glusteropts"]); err != nil {
+			return err
+		}
+	} else if _, _, err := ParseVolumeName(req.Name); err != nil {
+		return err
+	}
+	if err := validateQuota(req); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -51,7 +76,8 @@ func (p *gfsDriver) MountOptions(req *volume.CreateRequest) []string {
 		}
 		args = AppendVolumeOptionsByVolumeName(args, req.Name)
 	} else {
-		args = strings.Split(glusteropts, " ")
+		// The options are checked by Validate.
+		args, _ = parseGlusteropts(glusteropts)
 	}
 
 	return args
@@ -64,12 +90,66 @@ func (p *gfsDriver) PreMount(req *volume.MountRequest) error {
 func (p *gfsDriver) PostMount(req *volume.MountRequest) {
 }
 
+// ParentMountArgs removes the --subdir-mount argument so the volume itself
+// can be mounted to create the subdirectory.
+func (p *gfsDriver) ParentMountArgs(args []string) ([]string, string) {
+	var parentArgs []string
+	subdir := ""
+	for i := 0; i < len(args); i++ {
+		if strings.HasPrefix(args[i], "--subdir-mount=") {
+			subdir = strings.TrimPrefix(args[i], "--subdir-mount=")
+		} else if args[i] == "--subdir-mount" && i+1 < len(args) {
+			i++
+			subdir = args[i]
+		} else {
+			parentArgs = append(parentArgs, args[i])
+		}
+	}
+	return parentArgs, strings.Trim(subdir, "/")
+}
+
+// volumeNamePattern matches the names gluster accepts for volumes.
+var volumeNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// ParseVolumeName splits the name into the gluster volume and the optional
+// subdirectory within it.  A trailing slash is ignored, names that start with
+// a slash or contain empty, . or .. segments are rejected.
+func ParseVolumeName(volumeName string) (string, string, error) {
+	if volumeName == "" {
+		return "", "", fmt.Errorf("the volume name must not be empty")
+	}
+	if strings.HasPrefix(volumeName, "/") {
+		return "", "", fmt.Errorf("the volume name %s must not start with /", volumeName)
+	}
+	segments := strings.Split(strings.TrimSuffix(volumeName, "/"), "/")
+	for _, segment := range segments {
+		switch segment {
+		case "":
+			return "", "", fmt.Errorf("the volume name %s must not contain empty path segments", volumeName)
+		case ".", "..":
+			return "", "", fmt.Errorf("the volume name %s must not contain %s", volumeName, segment)
+		}
+	}
+	if len(segments[0]) > 64 || !volumeNamePattern.MatchString(segments[0]) {
+		return "", "", fmt.Errorf("%s is not a valid gluster volume name, it may only contain letters, digits, '_', '-' and '.' and be at most 64 characters", segments[0])
+	}
+	return segments[0], strings.Join(segments[1:], "/"), nil
+}
+
 // AppendVolumeOptionsByVolumeName appends the command line arguments into the current argument list given the volume name
 func AppendVolumeOptionsByVolumeName(args []string, volumeName string) []string {
-	parts := strings.SplitN(volumeName, "/", 2)
-	ret := append(args, "--volfile-id="+parts[0])
-	if len(parts) == 2 {
-		ret = append(ret, "--subdir-mount=/"+parts[1])
+	volfileID, subdir, err := ParseVolumeName(volumeName)
+	if err != nil {
+		// Not reachable for volumes that were checked by Validate.
+		parts := strings.SplitN(volumeName, "/", 2)
+		volfileID, subdir = parts[0], ""
+		if len(parts) == 2 {
+			subdir = parts[1]
+		}
+	}
+	ret := append(args, "--volfile-id="+volfileID)
+	if subdir != "" {
+		ret = append(ret, "--subdir-mount=/"+subdir)
 	}
 	return ret
 }
@@ -79,11 +159,54 @@ func buildDriver() *gfsDriver {
 	if os.Getenv("SERVERS") != "" {
 		servers = strings.Split(os.Getenv("SERVERS"), ",")
 	}
+	probeTimeout, err := time.ParseDuration(os.Getenv("SERVER_PROBE_TIMEOUT"))
+	if err != nil {
+		probeTimeout = 2 * time.Second
+	}
+	logLevel := strings.ToUpper(os.Getenv("LOG_LEVEL"))
+	if logLevel != "" && !validLogLevel(logLevel) {
+		log.Printf("invalid LOG_LEVEL %s, using INFO", logLevel)
+		logLevel = "INFO"
+	}
+	logMaxSize, err := strconv.ParseInt(os.Getenv("LOG_MAX_SIZE"), 10, 64)
+	if err != nil || logMaxSize <= 0 {
+		logMaxSize = 10
+	}
+	logKeep, err := strconv.Atoi(os.Getenv("LOG_KEEP"))
+	if err != nil || logKeep < 0 {
+		logKeep = 3
+	}
+	gluster, err := splitShellWords(os.Getenv("GLUSTER_CLI"))
+	if err != nil || len(gluster) == 0 {
+		if err != nil {
+			log.Printf("invalid GLUSTER_CLI: %s", err)
+		}
+		gluster = []string{"gluster"}
+	}
+	provision := provisionConfig{enabled: os.Getenv("PROVISION") == "true"}
+	if bricks := os.Getenv("PROVISION_BRICKS"); bricks != "" {
+		provision.bricks = strings.Split(bricks, ",")
+	}
+	if replica := os.Getenv("PROVISION_REPLICA"); replica != "" {
+		if provision.replica, err = strconv.Atoi(replica); err != nil {
+			log.Printf("invalid PROVISION_REPLICA %s, ignoring", replica)
+		}
+	}
 	d := &gfsDriver{
-		Driver:  *mountedvolume.NewDriver("glusterfs", true, "gfs", "local"),
-		servers: servers,
+		Driver:       *mountedvolume.NewDriver("glusterfs", true, "gfs", "local"),
+		servers:      servers,
+		probeTimeout: probeTimeout,
+		probes:       make(map[string][]string),
+		logDir:       defaultLogDir,
+		logLevel:     logLevel,
+		logMaxSize:   logMaxSize * 1024 * 1024,
+		logKeep:      logKeep,
+		logFiles:     make(map[string]string),
+		gluster:      gluster,
+		provision:    provision,
 	}
 	d.Init(d)
+	go d.rotateLogsPeriodically(10 * time.Minute)
 	return d
 }
 
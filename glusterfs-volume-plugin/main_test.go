@@ -2,8 +2,16 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
 )
 
 func TestVolumeCalculation(t *testing.T) {
@@ -35,3 +43,532 @@ func TestVolumeCalculationTwoLevels(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestParentMountArgs(t *testing.T) {
+	d := &gfsDriver{}
+	parentArgs, subdir := d.ParentMountArgs([]string{"-s", "store1", "--volfile-id=vol", "--subdir-mount=/levelone/level2"})
+	if !reflect.DeepEqual(parentArgs, []string{"-s", "store1", "--volfile-id=vol"}) || subdir != "levelone/level2" {
+		t.Errorf("unexpected %v %s", parentArgs, subdir)
+	}
+	parentArgs, subdir = d.ParentMountArgs([]string{"-s", "store1", "--volfile-id=vol"})
+	if !reflect.DeepEqual(parentArgs, []string{"-s", "store1", "--volfile-id=vol"}) || subdir != "" {
+		t.Errorf("unexpected %v %s", parentArgs, subdir)
+	}
+}
+
+func TestServerIndexes(t *testing.T) {
+	args := []string{"-s", "store1", "--volfile-server=store2", "--volfile-server", "store3", "--volfile-server-port=24008", "--volfile-id=vol"}
+	indexes, port := serverIndexes(args)
+	if !reflect.DeepEqual(indexes, []int{1, 2, 4}) || port != "24008" {
+		t.Errorf("unexpected %v %s", indexes, port)
+	}
+	if _, port := serverIndexes([]string{"-s", "store1"}); port != defaultGlusterdPort {
+		t.Errorf("unexpected port %s", port)
+	}
+}
+
+func TestProbeOrdersServers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := &gfsDriver{
+		probeTimeout: time.Second,
+		probes:       make(map[string][]string),
+		logDir:       dir,
+		logFiles:     make(map[string]string),
+		logMaxSize:   1024 * 1024,
+	}
+	req := &volume.MountRequest{Name: "vol", ID: "abc"}
+	args := []string{"-s", "127.0.0.2", "--volfile-server=127.0.0.1", "--volfile-server-port=" + port, "--volfile-id=vol", "--log-level=INFO"}
+
+	mountArgs, _, err := d.MountArgs(req, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"-s", "127.0.0.1", "--volfile-server=127.0.0.2", "--volfile-server-port=" + port, "--volfile-id=vol", "--log-level=INFO", "--log-file=" + filepath.Join(dir, "vol.log")}
+	if !reflect.DeepEqual(mountArgs, expected) {
+		t.Errorf("%v didn't match expected %v", mountArgs, expected)
+	}
+	status := d.MountStatus(req, nil)
+	probes, _ := status["serverProbe"].([]string)
+	if len(probes) != 2 || !strings.Contains(probes[0], "unreachable") || !strings.HasPrefix(probes[1], "127.0.0.1: reachable") {
+		t.Errorf("unexpected status %v", status)
+	}
+	if _, ok := d.MountStatus(req, nil)["serverProbe"]; ok {
+		t.Error("expected the probe results to be reported once")
+	}
+
+	l.Close()
+	if _, _, err := d.MountArgs(req, args); err == nil {
+		t.Error("expected an error when no server is reachable")
+	}
+	if _, ok := d.MountStatus(req, fmt.Errorf("unreachable"))["serverProbe"]; !ok {
+		t.Error("expected the probe results to be reported when no server is reachable")
+	}
+
+	d.probeTimeout = 0
+	if mountArgs, _, err := d.MountArgs(req, args); err != nil || !reflect.DeepEqual(mountArgs, append(args, "--log-file="+filepath.Join(dir, "vol.log"))) {
+		t.Errorf("expected no probe when disabled %v %v", mountArgs, err)
+	}
+}
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected []string
+	}{
+		{"-s store1  --volfile-id=vol", []string{"-s", "store1", "--volfile-id=vol"}},
+		{`--log-file="/var/log/my logs/vol.log"`, []string{"--log-file=/var/log/my logs/vol.log"}},
+		{`--xlator-option='*replicate*.data-self-heal=off'`, []string{"--xlator-option=*replicate*.data-self-heal=off"}},
+		{`--log-file=/tmp/a\ b "x\"y" 'it''s'`, []string{"--log-file=/tmp/a b", `x"y`, "its"}},
+		{`""`, []string{""}},
+		{"  ", nil},
+	}
+	for _, test := range tests {
+		words, err := splitShellWords(test.s)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.s, err)
+		} else if !reflect.DeepEqual(words, test.expected) {
+			t.Errorf("%s: %q didn't match expected %q", test.s, words, test.expected)
+		}
+	}
+	for _, s := range []string{`'unterminated`, `"unterminated`, `trailing\`} {
+		if _, err := splitShellWords(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestParseGlusteropts(t *testing.T) {
+	tests := []struct {
+		glusteropts string
+		valid       bool
+	}{
+		{"--volfile-server=SERVER --volfile-id=abc --subdir-mount=sub", true},
+		{"-s store1 -s store2 --volfile-id abc --acl --use-readdirp=no", true},
+		{`-s store1 --volfile-id="a b" --xlator-option "*.x=y z"`, true},
+		{`-s store1 --volfile-id=abc -l "/var/log/my logs/abc.log"`, false},
+		{"-s store1 --volfile-id=abc --log-file=/etc/shadow", false},
+		{"-s store1 --volfile-id=abc /mnt/elsewhere", false},
+		{"-s store1 --volfile-id=abc --pid-file=/tmp/pid", false},
+		{"-s store1 --volfile-id=abc -p /tmp/pid", false},
+		{"-s store1 --volfile-id=abc --unknown", false},
+		{"-s store1 --volfile-id", false},
+		{"-s 'store1", false},
+		{"-s store1 --volfile-id=abc --subdir-mount=/a/b", true},
+		{"-s store1 --volfile-id=abc --subdir-mount /../../var/lib", false},
+		{"-s store1 --volfile-id=abc --subdir-mount=a/./b", false},
+		{"-s store1 --volfile-id=abc --subdir-mount=", false},
+	}
+	for _, test := range tests {
+		_, err := parseGlusteropts(test.glusteropts)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.glusteropts, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.glusteropts)
+		}
+	}
+
+	d := &gfsDriver{}
+	args := d.MountOptions(&volume.CreateRequest{Name: "whatever", Options: map[string]string{"glusteropts": "-s  store1 --volfile-id='a b'"}})
+	if !reflect.DeepEqual(args, []string{"-s", "store1", "--volfile-id=a b"}) {
+		t.Errorf("unexpected %q", args)
+	}
+}
+
+func TestLogArgs(t *testing.T) {
+	d := &gfsDriver{logDir: "/var/log/glusterfs/volumes", logLevel: "DEBUG"}
+	args, logFile := d.logArgs("vol/sub", []string{"-s", "store1"})
+	expected := []string{"-s", "store1", "--log-file=/var/log/glusterfs/volumes/vol%2Fsub.log", "--log-level=DEBUG"}
+	if !reflect.DeepEqual(args, expected) || logFile != "/var/log/glusterfs/volumes/vol%2Fsub.log" {
+		t.Errorf("unexpected %v %s", args, logFile)
+	}
+	args, logFile = d.logArgs("vol", []string{"-s", "store1", "-l", "/tmp/my.log", "-L", "ERROR", "--log-file=/etc/shadow"})
+	expected = []string{"-s", "store1", "-L", "ERROR", "--log-file=/var/log/glusterfs/volumes/vol.log"}
+	if !reflect.DeepEqual(args, expected) || logFile != "/var/log/glusterfs/volumes/vol.log" {
+		t.Errorf("expected the log file of existing volumes to be replaced %v %s", args, logFile)
+	}
+}
+
+func TestGlusterfsLogFile(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"/usr/sbin/glusterfs", "--log-file=/var/log/glusterfs/volumes/vol.log", "--volfile-id=vol", "/mnt"}, "/var/log/glusterfs/volumes/vol.log"},
+		{[]string{"/usr/sbin/glusterfs", "-l", "/var/log/other.log", "/mnt"}, "/var/log/other.log"},
+		{[]string{"/usr/sbin/glusterfs", "--volfile-id=vol", "/mnt", ""}, ""},
+	}
+	for _, test := range tests {
+		if logFile := glusterfsLogFile(test.args); logFile != test.expected {
+			t.Errorf("glusterfsLogFile(%v) = %s, expected %s", test.args, logFile, test.expected)
+		}
+	}
+}
+
+func TestRotateLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "vol.log")
+
+	for i := 1; i <= 3; i++ {
+		if err := ioutil.WriteFile(file, []byte(strings.Repeat("x", 10*i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !rotateLog(file, 10, 2) {
+			t.Errorf("expected rotation %d", i)
+		}
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("expected the log to be renamed")
+	}
+	if content, _ := ioutil.ReadFile(file + ".1"); len(content) != 30 {
+		t.Errorf("unexpected .1 size %d", len(content))
+	}
+	if content, _ := ioutil.ReadFile(file + ".2"); len(content) != 20 {
+		t.Errorf("unexpected .2 size %d", len(content))
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Error("expected only two rotated logs to be kept")
+	}
+
+	ioutil.WriteFile(file, []byte("small"), 0644)
+	if rotateLog(file, 10, 2) {
+		t.Error("did not expect a small log to be rotated")
+	}
+}
+
+func TestRotateLogsSkipsMounting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := &gfsDriver{
+		logDir:     dir,
+		logMaxSize: 10,
+		logKeep:    1,
+		logFiles:   map[string]string{"mounting": filepath.Join(dir, "mounting.log")},
+	}
+	for _, name := range []string{"mounting", "idle"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".log"), []byte(strings.Repeat("x", 20)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.rotateLogs()
+	if _, err := os.Stat(filepath.Join(dir, "mounting.log")); err != nil {
+		t.Errorf("did not expect the log of a volume being mounted to be rotated: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "idle.log.1")); err != nil {
+		t.Errorf("expected the idle log to be rotated: %s", err)
+	}
+}
+
+func TestLogTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "vol.log")
+	var lines []string
+	for i := 0; i < 5000; i++ {
+		lines = append(lines, fmt.Sprintf("[E] line %d", i))
+	}
+	if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tail := logTail(file, 3)
+	if !reflect.DeepEqual(tail, []string{"[E] line 4997", "[E] line 4998", "[E] line 4999"}) {
+		t.Errorf("unexpected %v", tail)
+	}
+	if logTail(filepath.Join(dir, "missing.log"), 3) != nil {
+		t.Error("expected no tail for a missing log")
+	}
+}
+
+func TestParseVolumeName(t *testing.T) {
+	tests := []struct {
+		name      string
+		volfileID string
+		subdir    string
+		valid     bool
+	}{
+		{"simplevolume", "simplevolume", "", true},
+		{"simplevolume/levelone", "simplevolume", "levelone", true},
+		{"simplevolume/levelone/level2", "simplevolume", "levelone/level2", true},
+		{"simplevolume/", "simplevolume", "", true},
+		{"simplevolume/levelone/", "simplevolume", "levelone", true},
+		{"gv0.backup/data.d", "gv0.backup", "data.d", true},
+		{"", "", "", false},
+		{"/simplevolume", "", "", false},
+		{"simplevolume//levelone", "", "", false},
+		{"simplevolume/levelone//", "", "", false},
+		{"simplevolume/../other", "", "", false},
+		{"simplevolume/./levelone", "", "", false},
+		{"../simplevolume", "", "", false},
+		{"-volume", "", "", false},
+		{"bad volume", "", "", false},
+		{strings.Repeat("v", 65), "", "", false},
+	}
+	for _, test := range tests {
+		volfileID, subdir, err := ParseVolumeName(test.name)
+		if test.valid && err != nil {
+			t.Errorf("%q: unexpected error %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%q: expected an error", test.name)
+		} else if volfileID != test.volfileID || subdir != test.subdir {
+			t.Errorf("%q: unexpected %s %s", test.name, volfileID, subdir)
+		}
+	}
+
+	calculated := AppendVolumeOptionsByVolumeName([]string{"mount"}, "simplevolume/levelone/")
+	if !reflect.DeepEqual(calculated, []string{"mount", "--volfile-id=simplevolume", "--subdir-mount=/levelone"}) {
+		t.Errorf("%v didn't normalize the trailing slash", calculated)
+	}
+}
+
+func TestValidateVolumeName(t *testing.T) {
+	d := &gfsDriver{servers: []string{"store1"}}
+	if err := d.Validate(&volume.CreateRequest{Name: "vol/../other", Options: map[string]string{}}); err == nil {
+		t.Error("expected the volume name to be rejected")
+	}
+	if err := d.Validate(&volume.CreateRequest{Name: "vol/sub", Options: map[string]string{}}); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	d.servers = nil
+	if err := d.Validate(&volume.CreateRequest{Name: "/whatever", Options: map[string]string{"glusteropts": "--volfile-server=store1 --volfile-id=vol"}}); err != nil {
+		t.Errorf("did not expect the name to be checked when glusteropts is used: %s", err)
+	}
+}
+
+// fakeGluster writes a gluster executable that records its arguments and
+// reports the volumes listed in the existing file as present.
+func fakeGluster(t *testing.T, dir string) glusterCLI {
+	script := filepath.Join(dir, "gluster")
+	content := `#!/bin/sh
+echo "$@" >> ` + dir + `/invocations
+if [ "$2 $3" = "volume info" ]; then
+  if grep -qx "$4" ` + dir + `/existing 2>/dev/null; then
+    echo "Volume Name: $4"
+    exit 0
+  fi
+  echo "Volume $4 does not exist"
+  exit 1
+fi
+if [ "$2 $3" = "volume create" ]; then
+  echo "$4" >> ` + dir + `/existing
+fi
+echo "volume $3: $4: success"
+`
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return glusterCLI{script}
+}
+
+func invocations(dir string) []string {
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "invocations"))
+	os.Remove(filepath.Join(dir, "invocations"))
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func TestProvision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "existing"), []byte("present\n"), 0644)
+	d := &gfsDriver{
+		servers: []string{"store1"},
+		gluster: fakeGluster(t, dir),
+		provision: provisionConfig{
+			enabled: true,
+			replica: 2,
+			bricks:  []string{"store1:/bricks", "store2:/bricks/"},
+		},
+	}
+
+	if err := d.Provision(&volume.CreateRequest{Name: "present/sub", Options: map[string]string{}}); err != nil {
+		t.Fatal(err)
+	}
+	if calls := invocations(dir); !reflect.DeepEqual(calls, []string{"--mode=script volume info present"}) {
+		t.Errorf("unexpected invocations %v", calls)
+	}
+
+	if err := d.Provision(&volume.CreateRequest{Name: "missing/sub", Options: map[string]string{}}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"--mode=script volume info missing",
+		"--mode=script volume create missing replica 2 store1:/bricks/missing store2:/bricks/missing",
+		"--mode=script volume start missing",
+	}
+	if calls := invocations(dir); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("%v didn't match expected %v", calls, expected)
+	}
+
+	d.provision.bricks = nil
+	if err := d.Provision(&volume.CreateRequest{Name: "other", Options: map[string]string{}}); err == nil {
+		t.Error("expected an error when the volume does not exist and there are no bricks")
+	}
+	invocations(dir)
+
+	if err := d.Provision(&volume.CreateRequest{Name: "whatever", Options: map[string]string{"glusteropts": "--volfile-server=store1 --volfile-id=abc"}}); err != nil {
+		t.Errorf("did not expect glusteropts volumes to be provisioned: %s", err)
+	}
+	d.provision.enabled = false
+	if err := d.Provision(&volume.CreateRequest{Name: "other", Options: map[string]string{}}); err != nil {
+		t.Errorf("did not expect provisioning when disabled: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "invocations")); !os.IsNotExist(err) {
+		t.Error("did not expect the gluster CLI to be run")
+	}
+}
+
+func TestGlusterCLIError(t *testing.T) {
+	cli := glusterCLI{"sh", "-c", "echo 'Connection failed. Please check if gluster daemon is operational.'; exit 1", "gluster"}
+	if _, err := cli.volumeExists("vol"); err == nil || !strings.Contains(err.Error(), "gluster daemon") {
+		t.Errorf("expected the CLI failure to be reported %v", err)
+	}
+}
+
+// fakeGlusterQuota writes a gluster executable that records its arguments
+// and keeps track of whether quotas are enabled.
+func fakeGlusterQuota(t *testing.T, dir string) glusterCLI {
+	script := filepath.Join(dir, "gluster")
+	content := `#!/bin/sh
+echo "$@" >> ` + dir + `/invocations
+case "$5" in
+enable)
+  touch ` + dir + `/enabled
+  ;;
+limit-usage)
+  if [ ! -f ` + dir + `/enabled ]; then
+    echo "quota command failed : Quota is disabled, please enable quota"
+    exit 1
+  fi
+  ;;
+list)
+  echo "                  Path                   Hard-limit  Soft-limit      Used  Available  Soft-limit exceeded? Hard-limit exceeded?"
+  echo "-------------------------------------------------------------------------------------------------------------------------------"
+  echo "$6                                      10.0GB     80%(8.0GB)   1.5GB   8.5GB              No                   No"
+  ;;
+esac
+`
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return glusterCLI{script}
+}
+
+func TestValidateQuota(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		valid   bool
+	}{
+		{"vol/sub", map[string]string{"quota": "10GB"}, true},
+		{"vol/sub", map[string]string{"quota": "1.5TB", "remove_quota": "true"}, true},
+		{"vol/sub", map[string]string{"quota": "1024"}, true},
+		{"vol/sub", map[string]string{}, true},
+		{"vol", map[string]string{"quota": "10GB"}, false},
+		{"vol/sub", map[string]string{"quota": "ten"}, false},
+		{"vol/sub", map[string]string{"quota": "10GB", "remove_quota": "yes"}, false},
+		{"vol/sub", map[string]string{"remove_quota": "true"}, false},
+		{"whatever", map[string]string{"quota": "10GB", "glusteropts": "--volfile-id=vol"}, false},
+	}
+	for _, test := range tests {
+		err := validateQuota(&volume.CreateRequest{Name: test.name, Options: test.options})
+		if test.valid && err != nil {
+			t.Errorf("%s %v: unexpected error %s", test.name, test.options, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s %v: expected an error", test.name, test.options)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := &gfsDriver{gluster: fakeGlusterQuota(t, dir)}
+	req := &volume.MountRequest{Name: "vol/team/app", ID: "abc"}
+	options := map[string]string{"quota": "10GB"}
+	mountStatus := make(map[string]interface{})
+
+	if err := d.Mounted(req, options, mountStatus); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"--mode=script volume quota vol limit-usage /team/app 10GB",
+		"--mode=script volume quota vol enable",
+		"--mode=script volume quota vol limit-usage /team/app 10GB",
+	}
+	if calls := invocations(dir); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("%v didn't match expected %v", calls, expected)
+	}
+	if mountStatus["quotaLimitSetAt"] == nil {
+		t.Error("expected the limit to be recorded in the status")
+	}
+	if err := d.Mounted(req, options, mountStatus); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "invocations")); !os.IsNotExist(err) {
+		t.Error("did not expect the limit to be set again on the next mount")
+	}
+
+	// The usage is retrieved in the background on the first call.
+	status := d.VolumeStatus("vol/team/app", options)
+	if status["quota"] != "10GB" || status["quotaUsed"] != nil {
+		t.Errorf("unexpected status %v", status)
+	}
+	for i := 0; i < 100 && status["quotaUsed"] == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status = d.VolumeStatus("vol/team/app", options)
+	}
+	if status["quota"] != "10GB" || status["quotaUsed"] != "1.5GB" || status["quotaAvailable"] != "8.5GB" || status["quotaExceeded"] != false {
+		t.Errorf("unexpected status %v", status)
+	}
+	d.VolumeStatus("vol/team/app", options)
+	if calls := invocations(dir); !reflect.DeepEqual(calls, []string{"--mode=script volume quota vol list /team/app"}) {
+		t.Errorf("expected the usage to be cached %v", calls)
+	}
+
+	if err := d.Deprovision("vol/team/app", options); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "invocations")); !os.IsNotExist(err) {
+		t.Error("did not expect the quota to be removed without remove_quota")
+	}
+	if _, ok := d.quotas.entries["vol/team/app"]; ok {
+		t.Error("expected the cached usage to be removed")
+	}
+	options["remove_quota"] = "true"
+	if err := d.Deprovision("vol/team/app", options); err != nil {
+		t.Fatal(err)
+	}
+	if calls := invocations(dir); !reflect.DeepEqual(calls, []string{"--mode=script volume quota vol remove /team/app"}) {
+		t.Errorf("unexpected invocations %v", calls)
+	}
+
+	if err := d.Mounted(&volume.MountRequest{Name: "vol/other"}, map[string]string{}, map[string]interface{}{}); err != nil || d.VolumeStatus("vol/other", map[string]string{}) != nil {
+		t.Error("did not expect a volume without quota to use the gluster CLI")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "invocations")); !os.IsNotExist(err) {
+		t.Error("did not expect the gluster CLI to be run")
+	}
+}
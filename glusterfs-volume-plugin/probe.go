@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// defaultGlusterdPort is the port glusterd listens on for the volume files.
+const defaultGlusterdPort = "24007"
+
+// probeResult is the outcome of connecting to a server.
+type probeResult struct {
+	server  string
+	elapsed time.Duration
+	err     error
+}
+
+func (r probeResult) String() string {
+	if r.err != nil {
+		return fmt.Sprintf("%s: unreachable: %s", r.server, r.err)
+	}
+	return fmt.Sprintf("%s: reachable in %s", r.server, r.elapsed.Round(time.Millisecond))
+}
+
+// probeServers checks whether glusterd accepts TCP connections on each of the
+// servers concurrently.  The results are in the same order as the servers.
+func probeServers(servers []string, port string, timeout time.Duration) []probeResult {
+	results := make([]probeResult, len(servers))
+	done := make(chan struct{})
+	for i, server := range servers {
+		go func(i int, server string) {
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(server, port), timeout)
+			if err == nil {
+				conn.Close()
+			}
+			results[i] = probeResult{server: server, elapsed: time.Since(start), err: err}
+			done <- struct{}{}
+		}(i, server)
+	}
+	for range servers {
+		<-done
+	}
+	return results
+}
+
+// serverIndexes returns the positions of the server values in the glusterfs
+// arguments along with the glusterd port.
+func serverIndexes(args []string) ([]int, string) {
+	var indexes []int
+	port := defaultGlusterdPort
+	for i := 0; i < len(args); i++ {
+		switch {
+		case (args[i] == "-s" || args[i] == "--volfile-server") && i+1 < len(args):
+			i++
+			indexes = append(indexes, i)
+		case strings.HasPrefix(args[i], "--volfile-server="):
+			indexes = append(indexes, i)
+		case strings.HasPrefix(args[i], "--volfile-server-port="):
+			port = strings.TrimPrefix(args[i], "--volfile-server-port=")
+		case args[i] == "--volfile-server-port" && i+1 < len(args):
+			i++
+			port = args[i]
+		}
+	}
+	return indexes, port
+}
+
+// MountArgs adds the per volume log file and probes the servers before
+// mounting and orders them so the reachable ones are tried first.  The mount
+// fails straight away if none of the servers are reachable rather than
+// waiting for the glusterfs client to give up.
+func (p *gfsDriver) MountArgs(req *volume.MountRequest, args []string) ([]string, func(), error) {
+	noop := func() {}
+	// Called while the driver holds its lock, the log lock keeps the periodic
+	// rotation away from the log until MountStatus has read it.
+	p.logm.Lock()
+	args, p.logFiles[req.Name] = p.logArgs(req.Name, args)
+	if rotateLog(p.logFiles[req.Name], p.logMaxSize, p.logKeep) {
+		signalGlusterfs(syscall.SIGHUP, []string{p.logFiles[req.Name]})
+	}
+	p.logm.Unlock()
+
+	indexes, port := serverIndexes(args)
+	if p.probeTimeout <= 0 || len(indexes) == 0 {
+		return args, noop, nil
+	}
+
+	servers := make([]string, len(indexes))
+	for i, index := range indexes {
+		servers[i] = strings.TrimPrefix(args[index], "--volfile-server=")
+	}
+	results := probeServers(servers, port, p.probeTimeout)
+
+	var reachable, unreachable []string
+	var status []string
+	for _, result := range results {
+		if result.err == nil {
+			reachable = append(reachable, result.server)
+		} else {
+			unreachable = append(unreachable, result.server)
+		}
+		status = append(status, result.String())
+	}
+	p.probes[req.Name] = status
+
+	if len(reachable) == 0 {
+		return nil, noop, fmt.Errorf("none of the servers %s are reachable on port %s", strings.Join(servers, ", "), port)
+	}
+
+	mountArgs := append([]string{}, args...)
+	for i, server := range append(reachable, unreachable...) {
+		if strings.HasPrefix(mountArgs[indexes[i]], "--volfile-server=") {
+			mountArgs[indexes[i]] = "--volfile-server=" + server
+		} else {
+			mountArgs[indexes[i]] = server
+		}
+	}
+	return mountArgs, noop, nil
+}
+
+// MountStatus records the results of the last probe in the volume status
+// along with the end of the client log if the mount failed.
+func (p *gfsDriver) MountStatus(req *volume.MountRequest, mountErr error) map[string]interface{} {
+	status := make(map[string]interface{})
+	if probe, ok := p.probes[req.Name]; ok {
+		delete(p.probes, req.Name)
+		status["serverProbe"] = probe
+		status["serverProbeAt"] = time.Now().Format(time.RFC3339)
+	}
+	p.logm.Lock()
+	defer p.logm.Unlock()
+	if logFile, ok := p.logFiles[req.Name]; ok {
+		delete(p.logFiles, req.Name)
+		status["logFile"] = logFile
+		status["logTail"] = nil
+		if tail := logTail(logFile, logTailLines); mountErr != nil && len(tail) > 0 {
+			status["logTail"] = tail
+		}
+	}
+	return status
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// glusterCLI runs the gluster command line interface which may be a local
+// binary or a command such as ssh that runs it on one of the servers.
+type glusterCLI []string
+
+// glusterCLITimeout limits how long a gluster command may take as they are
+// run while the driver holds its lock.
+const glusterCLITimeout = 30 * time.Second
+
+// run executes the gluster CLI in script mode so it never prompts.
+func (c glusterCLI) run(args ...string) ([]byte, error) {
+	return c.runWithTimeout(glusterCLITimeout, args...)
+}
+
+// runWithTimeout executes the gluster CLI in script mode and kills it after
+// the timeout.
+func (c glusterCLI) runWithTimeout(timeout time.Duration, args ...string) ([]byte, error) {
+	cmdArgs := append(append([]string{}, c[1:]...), "--mode=script")
+	cmdArgs = append(cmdArgs, args...)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, c[0], cmdArgs...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("gluster %s failed: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// volumeExists checks whether the gluster volume exists.
+func (c glusterCLI) volumeExists(volfileID string) (bool, error) {
+	out, err := c.run("volume", "info", volfileID)
+	if err == nil {
+		return true, nil
+	}
+	if strings.Contains(string(out), "does not exist") {
+		return false, nil
+	}
+	return false, err
+}
+
+// provisionConfig holds how volumes that do not exist are created.
+type provisionConfig struct {
+	enabled bool
+	replica int
+	bricks  []string
+}
+
+// brickPaths returns the bricks for the volume within each of the brick
+// roots.
+func (c provisionConfig) brickPaths(volfileID string) []string {
+	var bricks []string
+	for _, root := range c.bricks {
+		bricks = append(bricks, strings.TrimSuffix(root, "/")+"/"+volfileID)
+	}
+	return bricks
+}
+
+// Provision ensures the gluster volume referenced by the name exists when
+// PROVISION is enabled.  A missing volume is created and started using
+// PROVISION_BRICKS and PROVISION_REPLICA if they are configured, otherwise
+// the creation of the docker volume fails.  Volumes using glusteropts are
+// not provisioned.
+func (p *gfsDriver) Provision(req *volume.CreateRequest) error {
+	if !p.provision.enabled {
+		return nil
+	}
+	if _, ok := req.Options["glusteropts"]; ok {
+		return nil
+	}
+	volfileID, _, err := ParseVolumeName(req.Name)
+	if err != nil {
+		return err
+	}
+	exists, err := p.gluster.volumeExists(volfileID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	if len(p.provision.bricks) == 0 {
+		return fmt.Errorf("gluster volume %s does not exist and PROVISION_BRICKS is not set", volfileID)
+	}
+
+	args := []string{"volume", "create", volfileID}
+	if p.provision.replica > 1 {
+		args = append(args, "replica", strconv.Itoa(p.provision.replica))
+	}
+	args = append(args, p.provision.brickPaths(volfileID)...)
+	if _, err := p.gluster.run(args...); err != nil {
+		return err
+	}
+	if _, err := p.gluster.run("volume", "start", volfileID); err != nil {
+		return err
+	}
+	log.Printf("created gluster volume %s", volfileID)
+	return nil
+}
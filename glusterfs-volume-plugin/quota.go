@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// quotaPattern matches the sizes accepted by gluster volume quota.
+var quotaPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(KB|MB|GB|TB|PB)?$`)
+
+// validateQuota checks driver_opts.quota and driver_opts.remove_quota.  A
+// quota can only be set on a subdirectory of a gluster volume.
+func validateQuota(req *volume.CreateRequest) error {
+	quota, ok := req.Options["quota"]
+	if !ok {
+		if _, ok := req.Options["remove_quota"]; ok {
+			return fmt.Errorf("remove_quota requires quota")
+		}
+		return nil
+	}
+	if _, ok := req.Options["glusteropts"]; ok {
+		return fmt.Errorf("quota cannot be used with glusteropts")
+	}
+	if !quotaPattern.MatchString(quota) {
+		return fmt.Errorf("quota must be a size such as 10GB: %s", quota)
+	}
+	if _, subdir, err := ParseVolumeName(req.Name); err != nil {
+		return err
+	} else if subdir == "" {
+		return fmt.Errorf("quota requires the volume name to refer to a subdirectory such as volume/subdir")
+	}
+	if removeQuota, ok := req.Options["remove_quota"]; ok && removeQuota != "true" && removeQuota != "false" {
+		return fmt.Errorf("remove_quota must be true or false: %s", removeQuota)
+	}
+	return nil
+}
+
+// quotaPath returns the gluster volume and the path of the subdirectory
+// within it if the volume has a quota.
+func quotaPath(volumeName string, options map[string]string) (string, string, bool) {
+	if _, ok := options["quota"]; !ok {
+		return "", "", false
+	}
+	volfileID, subdir, err := ParseVolumeName(volumeName)
+	if err != nil || subdir == "" {
+		return "", "", false
+	}
+	return volfileID, "/" + subdir, true
+}
+
+// Mounted sets the quota on the subdirectory the first time it is mounted as
+// the directory needs to exist.  Quotas are enabled on the gluster volume if
+// they are not already.  The time the limit was set is kept in the status so
+// later mounts leave the limit alone, including changes made by an
+// administrator.
+func (p *gfsDriver) Mounted(req *volume.MountRequest, options map[string]string, status map[string]interface{}) error {
+	volfileID, path, ok := quotaPath(req.Name, options)
+	if !ok {
+		return nil
+	}
+	if _, set := status["quotaLimitSetAt"]; set {
+		return nil
+	}
+	out, err := p.gluster.run("volume", "quota", volfileID, "limit-usage", path, options["quota"])
+	if err != nil && strings.Contains(strings.ToLower(string(out)), "quota is disabled") {
+		log.Printf("enabling quota on gluster volume %s", volfileID)
+		if _, err := p.gluster.run("volume", "quota", volfileID, "enable"); err != nil {
+			return err
+		}
+		_, err = p.gluster.run("volume", "quota", volfileID, "limit-usage", path, options["quota"])
+	}
+	if err != nil {
+		return err
+	}
+	status["quotaLimitSetAt"] = time.Now().Format(time.RFC3339)
+	return nil
+}
+
+// Deprovision forgets the cached usage of the quota and removes the quota
+// from the subdirectory if remove_quota is set.
+func (p *gfsDriver) Deprovision(volumeName string, options map[string]string) error {
+	p.quotas.m.Lock()
+	delete(p.quotas.entries, volumeName)
+	p.quotas.m.Unlock()
+
+	volfileID, path, ok := quotaPath(volumeName, options)
+	if !ok || options["remove_quota"] != "true" {
+		return nil
+	}
+	_, err := p.gluster.run("volume", "quota", volfileID, "remove", path)
+	return err
+}
+
+const (
+	// quotaRefreshInterval is how long the usage of a quota is reported
+	// before it is retrieved again.
+	quotaRefreshInterval = time.Minute
+
+	// quotaListTimeout limits how long retrieving the usage may take.
+	quotaListTimeout = 5 * time.Second
+)
+
+// quotaCache holds the last known usage of the quotas.  The usage is
+// retrieved in the background as VolumeStatus is called by docker while the
+// driver holds its lock.
+type quotaCache struct {
+	m       sync.Mutex
+	entries map[string]*quotaUsage
+}
+
+// quotaUsage is the usage of a quota and when it was retrieved.
+type quotaUsage struct {
+	status     map[string]interface{}
+	checkedAt  time.Time
+	refreshing bool
+}
+
+// VolumeStatus reports the last known usage of the quota and retrieves it
+// again in the background if it is older than quotaRefreshInterval.
+func (p *gfsDriver) VolumeStatus(volumeName string, options map[string]string) map[string]interface{} {
+	volfileID, path, ok := quotaPath(volumeName, options)
+	if !ok {
+		return nil
+	}
+	status := map[string]interface{}{"quota": options["quota"]}
+
+	p.quotas.m.Lock()
+	defer p.quotas.m.Unlock()
+	if p.quotas.entries == nil {
+		p.quotas.entries = make(map[string]*quotaUsage)
+	}
+	usage, ok := p.quotas.entries[volumeName]
+	if !ok {
+		usage = &quotaUsage{}
+		p.quotas.entries[volumeName] = usage
+	}
+	for k, v := range usage.status {
+		status[k] = v
+	}
+	if !usage.refreshing && time.Since(usage.checkedAt) >= quotaRefreshInterval {
+		usage.refreshing = true
+		go p.refreshQuota(usage, volfileID, path)
+	}
+	return status
+}
+
+// refreshQuota retrieves the usage of the quota.
+func (p *gfsDriver) refreshQuota(usage *quotaUsage, volfileID string, path string) {
+	status := make(map[string]interface{})
+	out, err := p.gluster.runWithTimeout(quotaListTimeout, "volume", "quota", volfileID, "list", path)
+	if err != nil {
+		status["quotaError"] = err.Error()
+	} else {
+		for k, v := range parseQuotaList(string(out), path) {
+			status[k] = v
+		}
+	}
+	checkedAt := time.Now()
+	status["quotaCheckedAt"] = checkedAt.Format(time.RFC3339)
+
+	p.quotas.m.Lock()
+	defer p.quotas.m.Unlock()
+	usage.status = status
+	usage.checkedAt = checkedAt
+	usage.refreshing = false
+}
+
+// parseQuotaList extracts the usage of the path from the output of gluster
+// volume quota list.
+func parseQuotaList(out string, path string) map[string]interface{} {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 7 || fields[0] != path {
+			continue
+		}
+		return map[string]interface{}{
+			"quotaUsed":      fields[3],
+			"quotaAvailable": fields[4],
+			"quotaExceeded":  fields[6] == "Yes",
+		}
+	}
+	return nil
+}
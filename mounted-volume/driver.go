@@ -7,18 +7,44 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"reflect"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/docker/go-plugins-helpers/volume"
 )
 
 type mountedVolumeInfo struct {
-	Options    map[string]string
-	MountPoint string
-	Args       []string
-	Status     map[string]interface{}
+	Options         map[string]string
+	MountPoint      string
+	Args            []string
+	Status          map[string]interface{}
+	CreatedAt       time.Time
+	LastMountedAt   time.Time
+	LastUnmountedAt time.Time
+	MountCount      int
+	Consumers       []string
+}
+
+// createdAt formats the creation time the way docker expects it.  Volumes
+// that were created before the time was tracked will yield an empty string.
+func (p *mountedVolumeInfo) createdAt() string {
+	if p.CreatedAt.IsZero() {
+		return ""
+	}
+	return p.CreatedAt.Format(time.RFC3339)
+}
+
+// mounted records that the volume has been mounted on the mount point.
+func (p *mountedVolumeInfo) mounted(mountPoint string) {
+	p.MountPoint = mountPoint
+	p.LastMountedAt = time.Now()
+	p.MountCount++
+	p.Status["mounted"] = true
+	p.Status["lastMountedAt"] = p.LastMountedAt.Format(time.RFC3339)
+	p.Status["mountCount"] = p.MountCount
 }
 
 // DriverCallback inteface specifies methods that need to be
@@ -39,6 +65,98 @@ type DriverCallback interface {
 	volume.Driver
 }
 
+// MountEnvironment may be implemented by a DriverCallback to pass additional
+// environment variables to the mount executable.  It is called after PreMount
+// with the arguments that will be passed to the mount executable.
+type MountEnvironment interface {
+	MountEnv(req *volume.MountRequest, args []string) ([]string, error)
+}
+
+// MountFallback may be implemented by a DriverCallback to retry a failed
+// mount with alternative arguments.  The arguments that succeed replace the
+// stored arguments so subsequent mounts use them directly.
+type MountFallback interface {
+	// FallbackArgs returns the alternative arguments to try in order given
+	// the stored arguments and the output of the failed mount.
+	FallbackArgs(args []string, output []byte) [][]string
+}
+
+// MountCandidates may be implemented by a DriverCallback along with
+// MountFallback when the mount negotiates a setting, such as the protocol
+// version, that should be fixed the first time the volume is mounted.  The
+// candidates are tried in order in place of the stored arguments and the
+// first that succeeds replaces them.  A failed candidate is only followed by
+// the next if FallbackArgs offers alternatives for the output so unrelated
+// errors fail the mount straight away.
+type MountCandidates interface {
+	// CandidateArgs returns the arguments to try in order given the stored
+	// arguments, nil if the stored arguments are to be used as they are.
+	CandidateArgs(args []string) [][]string
+}
+
+// CreateChecker may be implemented by a DriverCallback to check the remote
+// filesystem before a volume is created, for example that the server offers
+// it.  It is called before Validate without holding the driver lock so a slow
+// server does not block the other requests, and the volume is not created if
+// it returns an error.
+type CreateChecker interface {
+	CheckCreate(req *volume.CreateRequest) error
+}
+
+// Provisioner may be implemented by a DriverCallback to prepare the remote
+// filesystem when a volume is created, for example creating it if it does
+// not exist yet.  It is called after Validate and the volume is not created
+// if it returns an error.
+type Provisioner interface {
+	Provision(req *volume.CreateRequest) error
+}
+
+// Deprovisioner may be implemented by a DriverCallback along with
+// Provisioner to undo the preparation when the volume is removed.  The
+// volume is not removed if it returns an error.
+type Deprovisioner interface {
+	Deprovision(volumeName string, options map[string]string) error
+}
+
+// MountedHandler may be implemented by a DriverCallback to act on the remote
+// filesystem once the volume has been mounted, for example when it refers to
+// a subdirectory that only exists after the mount.  The volume is unmounted
+// and the mount fails if it returns an error.  Values set in the status are
+// stored with the volume so the handler can tell what it has already done.
+type MountedHandler interface {
+	Mounted(req *volume.MountRequest, options map[string]string, status map[string]interface{}) error
+}
+
+// VolumeStatusProvider may be implemented by a DriverCallback to add current
+// information about the remote filesystem to the status returned by Get.
+type VolumeStatusProvider interface {
+	VolumeStatus(volumeName string, options map[string]string) map[string]interface{}
+}
+
+// MountStatusReporter may be implemented by a DriverCallback to record
+// information about the last mount attempt in the volume status.  The status
+// is stored even if the mount failed.
+type MountStatusReporter interface {
+	// MountStatus returns the values to set in the status given the error
+	// from the mount if it failed.  The values must be basic types such as
+	// string, bool, int or []string, a nil value removes the key.
+	MountStatus(req *volume.MountRequest, mountErr error) map[string]interface{}
+}
+
+// ArgsRedactor may be implemented by a DriverCallback to mask sensitive
+// values in the arguments shown in the volume status.
+type ArgsRedactor interface {
+	RedactArgs(args []string) []string
+}
+
+// MountArgsProvider may be implemented by a DriverCallback to adjust the
+// stored arguments at mount time, for example to refer to a file that should
+// only exist while the mount executable runs.  The cleanup function is called
+// as soon as the mount executable returns.
+type MountArgsProvider interface {
+	MountArgs(req *volume.MountRequest, args []string) ([]string, func(), error)
+}
+
 // Driver extends the volume.Driver by implementing template versions
 // of the methods.
 type Driver struct {
@@ -48,6 +166,10 @@ type Driver struct {
 	volumedb               *bolt.DB
 	m                      *sync.RWMutex
 	scope                  string
+	hooks                  hooks
+	subdir                 subdirConfig
+	idleTimers             map[string]*time.Timer
+	isMountPoint           func(path string) bool
 	DriverCallback
 }
 
@@ -59,6 +181,12 @@ func (p *Driver) Capabilities() *volume.CapabilitiesResponse {
 // Create attempts to create the volume, if it has been created already it will
 // return an error if it is already present.
 func (p *Driver) Create(req *volume.CreateRequest) error {
+	if checker, ok := p.DriverCallback.(CreateChecker); ok {
+		if err := checker.CheckCreate(req); err != nil {
+			return err
+		}
+	}
+
 	p.m.Lock()
 	defer p.m.Unlock()
 
@@ -73,20 +201,36 @@ func (p *Driver) Create(req *volume.CreateRequest) error {
 		return fmt.Errorf("volume %s already exists", req.Name)
 	}
 
+	if _, err := ParseOwnership(req.Options); err != nil {
+		return err
+	}
+	if _, err := idleTimeout(req.Options); err != nil {
+		return err
+	}
+
 	if err := p.Validate(req); err != nil {
 		return err
 	}
+	if provisioner, ok := p.DriverCallback.(Provisioner); ok {
+		if err := provisioner.Provision(req); err != nil {
+			return err
+		}
+	}
 
 	args := p.MountOptions(req)
+	now := time.Now()
 	status := make(map[string]interface{})
 	status["mounted"] = false
 	status["args"] = args
+	status["createdAt"] = now.Format(time.RFC3339)
+	status["mountCount"] = 0
 
 	if err := p.storeVolumeInfo(tx, req.Name, &mountedVolumeInfo{
 		Options:    req.Options,
 		MountPoint: "",
 		Args:       args,
 		Status:     status,
+		CreatedAt:  now,
 	}); err != nil {
 		return err
 	}
@@ -120,7 +264,8 @@ func (p *Driver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
 		Volume: &volume.Volume{
 			Name:       req.Name,
 			Mountpoint: volumeInfo.MountPoint,
-			Status:     volumeInfo.Status,
+			CreatedAt:  volumeInfo.createdAt(),
+			Status:     p.volumeStatus(req.Name, volumeInfo),
 		},
 	}, nil
 }
@@ -142,12 +287,45 @@ func (p *Driver) List() (*volume.ListResponse, error) {
 		vols = append(vols, &volume.Volume{
 			Name:       k,
 			Mountpoint: v.MountPoint,
-			Status:     v.Status,
+			CreatedAt:  v.createdAt(),
+			Status:     p.status(&v),
 		})
 	}
 	return &volume.ListResponse{Volumes: vols}, nil
 }
 
+// status returns the status of the volume with the arguments redacted if
+// the callback supports it.
+func (p *Driver) status(volumeInfo *mountedVolumeInfo) map[string]interface{} {
+	redactor, ok := p.DriverCallback.(ArgsRedactor)
+	if !ok {
+		return volumeInfo.Status
+	}
+	status := make(map[string]interface{})
+	for k, v := range volumeInfo.Status {
+		status[k] = v
+	}
+	status["args"] = redactor.RedactArgs(volumeInfo.Args)
+	return status
+}
+
+// volumeStatus adds the information from the VolumeStatusProvider to the
+// status.
+func (p *Driver) volumeStatus(volumeName string, volumeInfo *mountedVolumeInfo) map[string]interface{} {
+	provider, ok := p.DriverCallback.(VolumeStatusProvider)
+	if !ok {
+		return p.status(volumeInfo)
+	}
+	status := make(map[string]interface{})
+	for k, v := range p.status(volumeInfo) {
+		status[k] = v
+	}
+	for k, v := range provider.VolumeStatus(volumeName, volumeInfo.Options) {
+		status[k] = v
+	}
+	return status
+}
+
 // Remove removes a specific volume.
 func (p *Driver) Remove(req *volume.RemoveRequest) error {
 	p.m.Lock()
@@ -159,7 +337,7 @@ func (p *Driver) Remove(req *volume.RemoveRequest) error {
 	}
 	defer tx.Rollback()
 
-	_, volumeExists, getVolErr := p.getVolumeInfo(tx, req.Name)
+	volumeInfo, volumeExists, getVolErr := p.getVolumeInfo(tx, req.Name)
 	if !volumeExists {
 		return fmt.Errorf("volume %s does not exist", req.Name)
 	}
@@ -167,6 +345,20 @@ func (p *Driver) Remove(req *volume.RemoveRequest) error {
 		return getVolErr
 	}
 
+	// A volume that is waiting for its idle timeout is still mounted.
+	if _, idle := p.idleTimers[req.Name]; idle {
+		p.cancelIdleUnmount(req.Name)
+		if err := p.unmount(req.Name, "", volumeInfo.MountPoint, volumeInfo); err != nil {
+			return err
+		}
+	}
+
+	if deprovisioner, ok := p.DriverCallback.(Deprovisioner); ok {
+		if err := deprovisioner.Deprovision(req.Name, volumeInfo.Options); err != nil {
+			return err
+		}
+	}
+
 	if err := p.removeVolumeInfo(tx, req.Name); err != nil {
 		return err
 	}
@@ -215,6 +407,41 @@ func (p *Driver) Mount(req *volume.MountRequest) (*volume.MountResponse, error)
 		return &volume.MountResponse{}, getVolErr
 	}
 
+	response, err := p.mount(req, volumeInfo)
+	reporter, reports := p.DriverCallback.(MountStatusReporter)
+	if reports {
+		for key, value := range reporter.MountStatus(req, err) {
+			if value == nil {
+				delete(volumeInfo.Status, key)
+			} else {
+				volumeInfo.Status[key] = value
+			}
+		}
+	}
+	// The status is kept when the mount fails so the reason can be inspected.
+	if err != nil && !reports {
+		return response, err
+	}
+	p.storeVolumeInfo(tx, req.Name, volumeInfo)
+	if commitErr := tx.Commit(); err == nil {
+		err = commitErr
+	}
+	return response, err
+}
+
+// mount mounts the volume and updates the volume info if it was successful.
+func (p *Driver) mount(req *volume.MountRequest, volumeInfo *mountedVolumeInfo) (*volume.MountResponse, error) {
+	// Volumes with an idle timeout are shared by all the containers while
+	// they remain mounted.
+	if timeout, _ := idleTimeout(volumeInfo.Options); timeout > 0 && volumeInfo.MountPoint != "" && p.sharedMountIsLive(req.Name, volumeInfo) {
+		p.cancelIdleUnmount(req.Name)
+		volumeInfo.mounted(volumeInfo.MountPoint)
+		volumeInfo.addConsumer(req.ID)
+		return &volume.MountResponse{
+			Mountpoint: volumeInfo.MountPoint,
+		}, nil
+	}
+
 	mountPoint := path.Join(volume.DefaultDockerRootDirectory, req.ID)
 	if err := os.MkdirAll(mountPoint, 0755); err != nil {
 		return &volume.MountResponse{}, fmt.Errorf("error mounting %s: %s", req.Name, err.Error())
@@ -225,30 +452,167 @@ func (p *Driver) Mount(req *volume.MountRequest) (*volume.MountResponse, error)
 	}
 	defer p.PostMount(req)
 
+	if err := p.hooks.preMount.run("pre-mount", req.Name, req.ID, mountPoint, volumeInfo.Options); err != nil {
+		return &volume.MountResponse{}, fmt.Errorf("error mounting %s: %s", req.Name, err.Error())
+	}
+
+	var env []string
+	var err error
+	if mountEnvironment, ok := p.DriverCallback.(MountEnvironment); ok {
+		if env, err = mountEnvironment.MountEnv(req, volumeInfo.Args); err != nil {
+			return &volume.MountResponse{}, fmt.Errorf("error mounting %s: %s", req.Name, err.Error())
+		}
+	}
+
+	// The subdirectory is created first as the mount fails if it does not
+	// exist.  The parent mount may already settle on fallback arguments.
+	args, err := p.createSubdir(req, volumeInfo.Args, env)
+	if err != nil {
+		return &volume.MountResponse{}, fmt.Errorf("error mounting %s: %s", req.Name, err.Error())
+	}
+
+	if candidates := p.candidateArgs(args); len(candidates) > 0 {
+		if args, err = p.mountCandidates(req, args, candidates, mountPoint, env); err != nil {
+			return &volume.MountResponse{}, fmt.Errorf("error mounting %s: %s", req.Name, err.Error())
+		}
+	} else if out, err := p.mountWithArgs(req, args, mountPoint, env); err != nil {
+		fmt.Printf("Command output: %s\n", out)
+		fallbackArgs, fallbackErr := p.mountFallback(req, args, out, mountPoint, env)
+		if fallbackErr != nil {
+			return &volume.MountResponse{}, fmt.Errorf("error mounting %s: %s", req.Name, err.Error())
+		}
+		args = fallbackArgs
+	}
+	if !reflect.DeepEqual(args, volumeInfo.Args) {
+		volumeInfo.Args = args
+		volumeInfo.Status["args"] = args
+	}
+	if err := p.applyOwnership(volumeInfo.Options, mountPoint); err != nil {
+		if unmountErr := syscall.Unmount(mountPoint, 0); unmountErr != nil {
+			log.Printf("error unmounting %s after ownership failure: %s", req.Name, unmountErr)
+		}
+		return &volume.MountResponse{}, fmt.Errorf("error mounting %s: %s", req.Name, err.Error())
+	}
+	if handler, ok := p.DriverCallback.(MountedHandler); ok {
+		if err := handler.Mounted(req, volumeInfo.Options, volumeInfo.Status); err != nil {
+			if unmountErr := syscall.Unmount(mountPoint, 0); unmountErr != nil {
+				log.Printf("error unmounting %s after mounted handler failure: %s", req.Name, unmountErr)
+			}
+			return &volume.MountResponse{}, fmt.Errorf("error mounting %s: %s", req.Name, err.Error())
+		}
+	}
+	if err := p.hooks.postMount.run("post-mount", req.Name, req.ID, mountPoint, volumeInfo.Options); err != nil {
+		if unmountErr := syscall.Unmount(mountPoint, 0); unmountErr != nil {
+			log.Printf("error unmounting %s after post-mount hook failure: %s", req.Name, unmountErr)
+		}
+		return &volume.MountResponse{}, fmt.Errorf("error mounting %s: %s", req.Name, err.Error())
+	}
+	volumeInfo.mounted(mountPoint)
+	volumeInfo.addConsumer(req.ID)
+	return &volume.MountResponse{
+		Mountpoint: volumeInfo.MountPoint,
+	}, nil
+}
+
+// applyOwnership applies the uid, gid and mode options to the root of the
+// mount unless the callback maps them to mount options itself.
+func (p *Driver) applyOwnership(options map[string]string, mountPoint string) error {
+	if mapper, ok := p.DriverCallback.(OwnershipMapper); ok && mapper.MapsOwnership() {
+		return nil
+	}
+	ownership, err := ParseOwnership(options)
+	if err != nil {
+		return err
+	}
+	return ownership.apply(mountPoint)
+}
+
+// mountWithArgs mounts using the stored arguments after they have been
+// adjusted by the callback for the duration of the mount.
+func (p *Driver) mountWithArgs(req *volume.MountRequest, storedArgs []string, mountPoint string, env []string) ([]byte, error) {
+	provider, ok := p.DriverCallback.(MountArgsProvider)
+	if !ok {
+		return p.runMount(storedArgs, mountPoint, env)
+	}
+	args, cleanup, err := provider.MountArgs(req, storedArgs)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	return p.runMount(args, mountPoint, env)
+}
+
+// mountFallback tries the alternative arguments provided by the callback in
+// order and returns the first that mounted successfully.
+func (p *Driver) mountFallback(req *volume.MountRequest, args []string, output []byte, mountPoint string, env []string) ([]string, error) {
+	fallback, ok := p.DriverCallback.(MountFallback)
+	if !ok {
+		return nil, fmt.Errorf("no fallback available")
+	}
+	for _, candidate := range fallback.FallbackArgs(args, output) {
+		out, err := p.mountWithArgs(req, candidate, mountPoint, env)
+		if err == nil {
+			log.Printf("mounted %s using fallback %v", req.Name, candidate)
+			return candidate, nil
+		}
+		log.Printf("Command output: %s\n", out)
+	}
+	return nil, fmt.Errorf("no fallback succeeded")
+}
+
+// candidateArgs returns the arguments provided by MountCandidates for the
+// stored arguments.
+func (p *Driver) candidateArgs(args []string) [][]string {
+	if candidates, ok := p.DriverCallback.(MountCandidates); ok {
+		return candidates.CandidateArgs(args)
+	}
+	return nil
+}
+
+// mountCandidates tries the candidates in order and returns the first that
+// mounted successfully.  The next candidate is only tried if the fallback
+// would retry the stored arguments given the output of the failed mount.
+func (p *Driver) mountCandidates(req *volume.MountRequest, args []string, candidates [][]string, mountPoint string, env []string) ([]string, error) {
+	fallback, _ := p.DriverCallback.(MountFallback)
+	var err error
+	for _, candidate := range candidates {
+		var out []byte
+		if out, err = p.mountWithArgs(req, candidate, mountPoint, env); err == nil {
+			log.Printf("mounted %s using %v", req.Name, candidate)
+			return candidate, nil
+		}
+		log.Printf("Command output: %s\n", out)
+		if fallback == nil || len(fallback.FallbackArgs(args, out)) == 0 {
+			break
+		}
+	}
+	return nil, err
+}
+
+// runMount invokes the mount executable with the arguments and the mount
+// point in the order expected by the executable.  The environment variables
+// are added to those of the plugin.
+func (p *Driver) runMount(mountArgs []string, mountPoint string, env []string) ([]byte, error) {
 	var args []string
 	if p.mountPointAfterOptions {
-		args = append(volumeInfo.Args, mountPoint)
+		args = append(args, mountArgs...)
+		args = append(args, mountPoint)
 	} else {
 		args = append(args, mountPoint)
-		args = append(args, volumeInfo.Args...)
+		args = append(args, mountArgs...)
 	}
 	log.Println(args)
 	cmd := exec.Command(p.mountExecutable, args...)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		fmt.Printf("Command output: %s\n", out)
-		return &volume.MountResponse{}, fmt.Errorf("error mounting %s: %s", req.Name, err.Error())
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
-	volumeInfo.MountPoint = mountPoint
-	volumeInfo.Status["mounted"] = true
-	p.storeVolumeInfo(tx, req.Name, volumeInfo)
-	return &volume.MountResponse{
-		Mountpoint: volumeInfo.MountPoint,
-	}, tx.Commit()
+	return cmd.CombinedOutput()
 }
 
 // Unmount uses the system call Unmount to do the unmounting.  If the umount
 // call comes with EINVAL then this will log the error but will not fail the
-// operation.
+// operation.  Volumes with an idle timeout are only unmounted once no
+// container has used them for the duration of the timeout.
 func (p *Driver) Unmount(req *volume.UnmountRequest) error {
 	p.m.Lock()
 	defer p.m.Unlock()
@@ -267,29 +631,56 @@ func (p *Driver) Unmount(req *volume.UnmountRequest) error {
 		return getVolErr
 	}
 
+	volumeInfo.removeConsumer(req.ID)
+	if timeout, _ := idleTimeout(volumeInfo.Options); timeout > 0 {
+		if len(volumeInfo.Consumers) == 0 && volumeInfo.MountPoint != "" {
+			p.scheduleIdleUnmount(req.Name, timeout)
+		}
+		p.storeVolumeInfo(tx, req.Name, volumeInfo)
+		return tx.Commit()
+	}
+
 	mountPoint := path.Join(volume.DefaultDockerRootDirectory, req.ID)
+	if err := p.unmount(req.Name, req.ID, mountPoint, volumeInfo); err != nil {
+		return err
+	}
+	p.storeVolumeInfo(tx, req.Name, volumeInfo)
+	return tx.Commit()
+}
+
+// unmount runs the pre-unmount hook, unmounts the mount point and removes
+// it.  The volume info is updated but not stored.
+func (p *Driver) unmount(volumeName string, id string, mountPoint string, volumeInfo *mountedVolumeInfo) error {
+	if err := p.hooks.preUnmount.run("pre-unmount", volumeName, id, mountPoint, volumeInfo.Options); err != nil {
+		return fmt.Errorf("error unmounting %s: %s", volumeName, err.Error())
+	}
 	if err := syscall.Unmount(mountPoint, 0); err != nil {
 		errno := err.(syscall.Errno)
 		if errno == syscall.EINVAL {
-			log.Printf("error unmounting invalid mount %s: %s", req.Name, err.Error())
+			log.Printf("error unmounting invalid mount %s: %s", volumeName, err.Error())
 		} else {
-			return fmt.Errorf("error unmounting %s: %s", req.Name, err.Error())
+			return fmt.Errorf("error unmounting %s: %s", volumeName, err.Error())
 		}
 	}
 	volumeInfo.MountPoint = ""
+	volumeInfo.LastUnmountedAt = time.Now()
 	volumeInfo.Status["mounted"] = false
+	volumeInfo.Status["lastUnmountedAt"] = volumeInfo.LastUnmountedAt.Format(time.RFC3339)
 
 	if err := os.Remove(mountPoint); err != nil {
-		return fmt.Errorf("error unmounting %s: %s", req.Name, err.Error())
+		return fmt.Errorf("error unmounting %s: %s", volumeName, err.Error())
 	}
-	p.storeVolumeInfo(tx, req.Name, volumeInfo)
-	return tx.Commit()
+	return nil
 }
 
 // Init sets the callback handler to the driver.  This needs to be called
-// before ServeUnix()
+// before ServeUnix().  Volumes that are no longer mounted since the plugin
+// was stopped are reset and the idle timers of the remaining volumes are
+// restarted.
 func (p *Driver) Init(callback DriverCallback) {
 	p.DriverCallback = callback
+	p.resetStaleMounts()
+	p.scheduleIdleVolumes()
 }
 
 // ServeUnix makes the handler to listen for requests in a unix socket.
@@ -312,6 +703,11 @@ func (p *Driver) ServeUnix() {
 
 // Close clean up resources used by the driver
 func (p *Driver) Close() {
+	p.m.Lock()
+	for volumeName := range p.idleTimers {
+		p.cancelIdleUnmount(volumeName)
+	}
+	p.m.Unlock()
 	p.volumedb.Close()
 }
 
@@ -336,6 +732,10 @@ func NewDriver(mountExecutable string, mountPointAfterOptions bool, dockerSocket
 		dockerSocketName:       dockerSocketName,
 		volumedb:               db,
 		scope:                  scope,
+		hooks:                  hooksFromEnv(),
+		subdir:                 subdirConfigFromEnv(),
+		idleTimers:             make(map[string]*time.Timer),
+		isMountPoint:           isMountPoint,
 		m:                      &sync.RWMutex{},
 	}
 	return d
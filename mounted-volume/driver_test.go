@@ -2,8 +2,14 @@ package mountedvolume
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/docker/go-plugins-helpers/volume"
@@ -24,6 +30,13 @@ func (p *testDriver) MountOptions(req *volume.CreateRequest) []string {
 	return args
 }
 
+func (p *testDriver) PreMount(req *volume.MountRequest) error {
+	return nil
+}
+
+func (p *testDriver) PostMount(req *volume.MountRequest) {
+}
+
 func TestCapabilities(t *testing.T) {
 	d := &testDriver{
 		Driver: *NewDriver("glusterfs", true, "gfs1", "local"),
@@ -95,3 +108,241 @@ func TestDatabase(t *testing.T) {
 	}
 
 }
+
+func TestCreatedAt(t *testing.T) {
+	d := &testDriver{
+		Driver: *NewDriver("glusterfs", true, "gfs4", "local"),
+	}
+	defer d.Close()
+	defer os.Remove("gfs4.db")
+	d.Init(d)
+
+	if err := d.Create(&volume.CreateRequest{
+		Name: "test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := d.Get(&volume.GetRequest{Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := time.Parse(time.RFC3339, resp.Volume.CreatedAt); err != nil {
+		t.Errorf("unexpected CreatedAt %q: %s", resp.Volume.CreatedAt, err)
+	}
+	if resp.Volume.Status["createdAt"] != resp.Volume.CreatedAt {
+		t.Errorf("expected createdAt status to be %s", resp.Volume.CreatedAt)
+	}
+	if resp.Volume.Status["mountCount"] != 0 {
+		t.Errorf("expected mountCount to be 0 got %v", resp.Volume.Status["mountCount"])
+	}
+
+	list, err := d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Volumes) != 1 || list.Volumes[0].CreatedAt != resp.Volume.CreatedAt {
+		t.Errorf("expected List to return the same CreatedAt")
+	}
+}
+
+type reportingDriver struct {
+	testDriver
+}
+
+func (p *reportingDriver) MountStatus(req *volume.MountRequest, mountErr error) map[string]interface{} {
+	return map[string]interface{}{"attempt": req.ID, "failed": mountErr != nil, "createdAt": nil}
+}
+
+func TestMountStatusKeptOnFailure(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating the mount point requires root")
+	}
+	d := &reportingDriver{
+		testDriver: testDriver{Driver: *NewDriver("false", true, "gfs5", "local")},
+	}
+	defer d.Close()
+	defer os.Remove("gfs5.db")
+	d.Init(d)
+
+	if err := d.Create(&volume.CreateRequest{Name: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path.Join(volume.DefaultDockerRootDirectory, "reported"))
+	if _, err := d.Mount(&volume.MountRequest{Name: "test", ID: "reported"}); err == nil {
+		t.Fatal("expected the mount to fail")
+	}
+	get, err := d.Get(&volume.GetRequest{Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if get.Volume.Status["attempt"] != "reported" || get.Volume.Status["failed"] != true {
+		t.Errorf("expected the status to be kept got %v", get.Volume.Status)
+	}
+	if get.Volume.Status["mounted"] == true {
+		t.Error("did not expect the volume to be mounted")
+	}
+	if _, ok := get.Volume.Status["createdAt"]; ok {
+		t.Error("expected a nil value to remove the status")
+	}
+}
+
+type provisioningDriver struct {
+	testDriver
+	provisioned []string
+	err         error
+}
+
+func (p *provisioningDriver) Provision(req *volume.CreateRequest) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.provisioned = append(p.provisioned, req.Name)
+	return nil
+}
+
+func TestProvision(t *testing.T) {
+	d := &provisioningDriver{
+		testDriver: testDriver{Driver: *NewDriver("glusterfs", true, "gfs6", "local")},
+	}
+	defer d.Close()
+	defer os.Remove("gfs6.db")
+	d.Init(d)
+
+	if err := d.Create(&volume.CreateRequest{Name: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.provisioned) != 1 || d.provisioned[0] != "test" {
+		t.Errorf("expected the volume to be provisioned %v", d.provisioned)
+	}
+
+	d.err = fmt.Errorf("no bricks")
+	if err := d.Create(&volume.CreateRequest{Name: "failed"}); err == nil {
+		t.Error("expected the creation to fail")
+	}
+	if _, err := d.Get(&volume.GetRequest{Name: "failed"}); err == nil {
+		t.Error("did not expect the volume to be created")
+	}
+}
+
+func (p *provisioningDriver) Deprovision(volumeName string, options map[string]string) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.provisioned = p.provisioned[:0]
+	return nil
+}
+
+func (p *provisioningDriver) VolumeStatus(volumeName string, options map[string]string) map[string]interface{} {
+	return map[string]interface{}{"live": options["live"]}
+}
+
+func TestDeprovisionAndVolumeStatus(t *testing.T) {
+	d := &provisioningDriver{
+		testDriver: testDriver{Driver: *NewDriver("glusterfs", true, "gfs7", "local")},
+	}
+	defer d.Close()
+	defer os.Remove("gfs7.db")
+	d.Init(d)
+
+	if err := d.Create(&volume.CreateRequest{Name: "test", Options: map[string]string{"live": "yes"}}); err != nil {
+		t.Fatal(err)
+	}
+	get, err := d.Get(&volume.GetRequest{Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if get.Volume.Status["live"] != "yes" || get.Volume.Status["mounted"] != false {
+		t.Errorf("unexpected status %v", get.Volume.Status)
+	}
+
+	d.err = fmt.Errorf("quota busy")
+	if err := d.Remove(&volume.RemoveRequest{Name: "test"}); err == nil {
+		t.Error("expected the removal to fail")
+	}
+	d.err = nil
+	if err := d.Remove(&volume.RemoveRequest{Name: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.provisioned) != 0 {
+		t.Errorf("expected the volume to be deprovisioned %v", d.provisioned)
+	}
+}
+
+// fallbackDriver mounts parent/sub and only succeeds with vers=2.
+type fallbackDriver struct {
+	testDriver
+}
+
+func (p *fallbackDriver) MountOptions(req *volume.CreateRequest) []string {
+	return []string{"-o", "rw", "parent/sub"}
+}
+
+func (p *fallbackDriver) ParentMountArgs(args []string) ([]string, string) {
+	return append(append([]string{}, args[:len(args)-1]...), "parent"), "sub"
+}
+
+func (p *fallbackDriver) FallbackArgs(args []string, output []byte) [][]string {
+	if !strings.Contains(string(output), "Operation not supported") {
+		return nil
+	}
+	var candidates [][]string
+	for _, vers := range []string{"1", "2"} {
+		candidates = append(candidates, []string{"-o", args[1] + ",vers=" + vers, args[2]})
+	}
+	return candidates
+}
+
+func TestSubdirFallback(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mount requires root")
+	}
+	dir, err := ioutil.TempDir("", "fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "mount")
+	content := `#!/bin/sh
+echo "$2 $3" >> ` + dir + `/invocations
+case "$2" in
+*vers=2)
+  exec mount -t tmpfs tmpfs "$4"
+  ;;
+esac
+echo "Operation not supported"
+exit 1
+`
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &fallbackDriver{
+		testDriver: testDriver{Driver: *NewDriver(script, true, "gfs8", "local")},
+	}
+	defer d.Close()
+	defer os.Remove("gfs8.db")
+	d.Init(d)
+	d.subdir = subdirConfig{create: true, mode: 0755, uid: -1, gid: -1}
+
+	if err := d.Create(&volume.CreateRequest{Name: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Mount(&volume.MountRequest{Name: "test", ID: "subdir-fallback"}); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Unmount(&volume.UnmountRequest{Name: "test", ID: "subdir-fallback"})
+
+	calls, _ := ioutil.ReadFile(filepath.Join(dir, "invocations"))
+	expected := "rw parent\nrw,vers=1 parent\nrw,vers=2 parent\nrw,vers=2 parent/sub\n"
+	if string(calls) != expected {
+		t.Errorf("unexpected invocations %q expected %q", calls, expected)
+	}
+	get, err := d.Get(&volume.GetRequest{Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := get.Volume.Status["args"]; !reflect.DeepEqual(args, []string{"-o", "rw,vers=2", "parent/sub"}) {
+		t.Errorf("expected the fallback arguments to be stored got %v", args)
+	}
+}
@@ -0,0 +1,136 @@
+package mountedvolume
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const defaultHookTimeout = 30 * time.Second
+
+// Hook is a shell command that is executed around the mount and unmount
+// operations.  The volume name, mount request ID, mount point and options
+// are passed to the command as environment variables.
+type Hook struct {
+	// Command is run with /bin/sh -c, an empty command disables the hook.
+	Command string
+	// Timeout after which the command is killed and treated as failed.
+	Timeout time.Duration
+	// Abort makes a failure of the hook fail the operation.  When false the
+	// failure is only logged.
+	Abort bool
+}
+
+type hooks struct {
+	preMount   Hook
+	postMount  Hook
+	preUnmount Hook
+}
+
+// hookFromEnv builds the hook from the environment variables prefix_HOOK,
+// prefix_HOOK_TIMEOUT and prefix_HOOK_FAILURE.
+func hookFromEnv(prefix string) Hook {
+	h := Hook{
+		Command: os.Getenv(prefix + "_HOOK"),
+		Timeout: defaultHookTimeout,
+		Abort:   true,
+	}
+	if timeout := os.Getenv(prefix + "_HOOK_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			log.Printf("invalid %s_HOOK_TIMEOUT %s, using %s", prefix, timeout, defaultHookTimeout)
+		} else {
+			h.Timeout = d
+		}
+	}
+	switch policy := os.Getenv(prefix + "_HOOK_FAILURE"); policy {
+	case "", "abort":
+	case "warn":
+		h.Abort = false
+	default:
+		log.Printf("invalid %s_HOOK_FAILURE %s, using abort", prefix, policy)
+	}
+	return h
+}
+
+func hooksFromEnv() hooks {
+	return hooks{
+		preMount:   hookFromEnv("PREMOUNT"),
+		postMount:  hookFromEnv("POSTMOUNT"),
+		preUnmount: hookFromEnv("PREUNMOUNT"),
+	}
+}
+
+// hookEnv builds the environment variables passed to the hook.  Each option
+// is passed as VOLUME_OPT_<KEY> along with VOLUME_OPTIONS which contains all
+// of them as a comma separated list of key=value sorted by key.
+func hookEnv(volumeName string, id string, mountPoint string, options map[string]string) []string {
+	env := []string{
+		"VOLUME_NAME=" + volumeName,
+		"VOLUME_ID=" + id,
+		"VOLUME_MOUNTPOINT=" + mountPoint,
+	}
+	var keys []string
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+options[k])
+		envKey := strings.ToUpper(strings.Map(func(r rune) rune {
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+				return r
+			}
+			return '_'
+		}, k))
+		env = append(env, "VOLUME_OPT_"+envKey+"="+options[k])
+	}
+	return append(env, "VOLUME_OPTIONS="+strings.Join(pairs, ","))
+}
+
+// run executes the hook.  An error is only returned if the hook failed and
+// is configured to abort the operation.
+func (h Hook) run(hookName string, volumeName string, id string, mountPoint string, options map[string]string) error {
+	if h.Command == "" {
+		return nil
+	}
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", h.Command)
+	cmd.Env = append(os.Environ(), hookEnv(volumeName, id, mountPoint, options)...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// The hook runs in its own process group so that any child processes
+	// it spawned are killed along with it on timeout.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err = <-done:
+		case <-time.After(h.Timeout):
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			<-done
+			err = fmt.Errorf("timed out after %s", h.Timeout)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	if out.Len() > 0 {
+		log.Printf("%s hook output for %s: %s", hookName, volumeName, out.String())
+	}
+	if h.Abort {
+		return fmt.Errorf("%s hook failed: %s", hookName, err.Error())
+	}
+	log.Printf("%s hook failed for %s, continuing: %s", hookName, volumeName, err)
+	return nil
+}
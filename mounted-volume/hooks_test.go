@@ -0,0 +1,98 @@
+package mountedvolume
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookEnv(t *testing.T) {
+	env := hookEnv("vol/sub", "abc", "/mnt/abc", map[string]string{
+		"servers":     "store1,store2",
+		"glusteropts": "-s x",
+	})
+	expected := []string{
+		"VOLUME_NAME=vol/sub",
+		"VOLUME_ID=abc",
+		"VOLUME_MOUNTPOINT=/mnt/abc",
+		"VOLUME_OPT_GLUSTEROPTS=-s x",
+		"VOLUME_OPT_SERVERS=store1,store2",
+		"VOLUME_OPTIONS=glusteropts=-s x,servers=store1,store2",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("%v didn't match expected %v", env, expected)
+	}
+}
+
+func TestHookDisabled(t *testing.T) {
+	if err := (Hook{}).run("pre-mount", "vol", "id", "/mnt", nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHookReceivesEnvironment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	h := Hook{
+		Command: "echo $VOLUME_NAME $VOLUME_MOUNTPOINT $VOLUME_OPT_UID > " + out,
+		Timeout: time.Second,
+		Abort:   true,
+	}
+	if err := h.run("post-mount", "vol", "id", "/mnt/id", map[string]string{"uid": "1000"}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(b)) != "vol /mnt/id 1000" {
+		t.Errorf("unexpected hook output %q", b)
+	}
+}
+
+func TestHookFailurePolicy(t *testing.T) {
+	abort := Hook{Command: "exit 1", Timeout: time.Second, Abort: true}
+	if err := abort.run("pre-mount", "vol", "id", "/mnt", nil); err == nil {
+		t.Error("expected abort policy to return an error")
+	}
+	warn := Hook{Command: "exit 1", Timeout: time.Second}
+	if err := warn.run("pre-mount", "vol", "id", "/mnt", nil); err != nil {
+		t.Errorf("expected warn policy to not return an error: %s", err)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	h := Hook{Command: "sleep 5", Timeout: 100 * time.Millisecond, Abort: true}
+	start := time.Now()
+	err := h.run("pre-unmount", "vol", "id", "/mnt", nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected timeout error got %v", err)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Error("hook was not killed on timeout")
+	}
+}
+
+func TestHookFromEnv(t *testing.T) {
+	os.Setenv("TESTHOOK_HOOK", "true")
+	os.Setenv("TESTHOOK_HOOK_TIMEOUT", "5s")
+	os.Setenv("TESTHOOK_HOOK_FAILURE", "warn")
+	defer os.Unsetenv("TESTHOOK_HOOK")
+	defer os.Unsetenv("TESTHOOK_HOOK_TIMEOUT")
+	defer os.Unsetenv("TESTHOOK_HOOK_FAILURE")
+
+	h := hookFromEnv("TESTHOOK")
+	expected := Hook{Command: "true", Timeout: 5 * time.Second, Abort: false}
+	if h != expected {
+		t.Errorf("%v didn't match expected %v", h, expected)
+	}
+}
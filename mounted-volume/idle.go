@@ -0,0 +1,198 @@
+package mountedvolume
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// idleTimeout parses the idle_timeout driver option.  A zero duration is
+// returned if it is not specified, in which case the volume is unmounted as
+// soon as a container releases it.
+func idleTimeout(options map[string]string) (time.Duration, error) {
+	value, ok := options["idle_timeout"]
+	if !ok {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("idle_timeout must be a positive duration such as 10m: %s", value)
+	}
+	return d, nil
+}
+
+// addConsumer registers the mount request ID as holding the volume.
+func (p *mountedVolumeInfo) addConsumer(id string) {
+	for _, consumer := range p.Consumers {
+		if consumer == id {
+			return
+		}
+	}
+	p.Consumers = append(p.Consumers, id)
+	p.Status["consumers"] = len(p.Consumers)
+}
+
+// reset forgets the mount point and the consumers of a volume whose
+// filesystem is no longer mounted.
+func (p *mountedVolumeInfo) reset() {
+	p.MountPoint = ""
+	p.Consumers = nil
+	if p.Status == nil {
+		p.Status = make(map[string]interface{})
+	}
+	p.Status["mounted"] = false
+	if _, ok := p.Status["consumers"]; ok {
+		p.Status["consumers"] = 0
+	}
+}
+
+// removeConsumer releases the volume from the mount request ID.
+func (p *mountedVolumeInfo) removeConsumer(id string) {
+	var consumers []string
+	for _, consumer := range p.Consumers {
+		if consumer != id {
+			consumers = append(consumers, consumer)
+		}
+	}
+	p.Consumers = consumers
+	p.Status["consumers"] = len(p.Consumers)
+}
+
+// scheduleIdleUnmount starts the timer that unmounts the volume once it has
+// been idle for the timeout.  This must be called while holding the lock.
+func (p *Driver) scheduleIdleUnmount(volumeName string, timeout time.Duration) {
+	p.cancelIdleUnmount(volumeName)
+	var t *time.Timer
+	t = time.AfterFunc(timeout, func() {
+		p.idleUnmount(volumeName, t)
+	})
+	p.idleTimers[volumeName] = t
+	log.Printf("%s is idle, it will be unmounted in %s", volumeName, timeout)
+}
+
+// cancelIdleUnmount stops the pending idle timer for the volume if there is
+// one.  This must be called while holding the lock.
+func (p *Driver) cancelIdleUnmount(volumeName string) {
+	if t, ok := p.idleTimers[volumeName]; ok {
+		t.Stop()
+		delete(p.idleTimers, volumeName)
+	}
+}
+
+// idleUnmount unmounts the volume if no container has mounted it since the
+// timer was started.
+func (p *Driver) idleUnmount(volumeName string, t *time.Timer) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.idleTimers[volumeName] != t {
+		return
+	}
+	delete(p.idleTimers, volumeName)
+
+	tx, err := p.volumedb.Begin(true)
+	if err != nil {
+		log.Printf("error unmounting idle volume %s: %s", volumeName, err)
+		return
+	}
+	defer tx.Rollback()
+
+	volumeInfo, volumeExists, err := p.getVolumeInfo(tx, volumeName)
+	if !volumeExists || err != nil || len(volumeInfo.Consumers) > 0 || volumeInfo.MountPoint == "" {
+		return
+	}
+	if err := p.unmount(volumeName, "", volumeInfo.MountPoint, volumeInfo); err != nil {
+		log.Printf("error unmounting idle volume %s: %s", volumeName, err)
+		return
+	}
+	if err := p.storeVolumeInfo(tx, volumeName, volumeInfo); err != nil {
+		log.Printf("error unmounting idle volume %s: %s", volumeName, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("error unmounting idle volume %s: %s", volumeName, err)
+		return
+	}
+	log.Printf("unmounted idle volume %s", volumeName)
+}
+
+// scheduleIdleVolumes restarts the idle timers for volumes that were left
+// mounted without any consumers when the plugin was stopped.
+func (p *Driver) scheduleIdleVolumes() {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	tx, err := p.volumedb.Begin(false)
+	if err != nil {
+		log.Printf("unable to schedule idle volumes: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	volumeMap, err := p.getVolumeMap(tx)
+	if err != nil {
+		log.Printf("unable to schedule idle volumes: %s", err)
+		return
+	}
+	for name, info := range volumeMap {
+		timeout, err := idleTimeout(info.Options)
+		if err == nil && timeout > 0 && info.MountPoint != "" && len(info.Consumers) == 0 {
+			p.scheduleIdleUnmount(name, timeout)
+		}
+	}
+}
+
+// sharedMountIsLive checks that the mount point of a volume shared by the
+// containers is still mounted.  If it is not, for example after the host
+// was rebooted, the volume is reset so it is mounted again rather than
+// handing out an empty local directory.  This must be called while holding
+// the lock.
+func (p *Driver) sharedMountIsLive(volumeName string, volumeInfo *mountedVolumeInfo) bool {
+	if p.isMountPoint(volumeInfo.MountPoint) {
+		return true
+	}
+	log.Printf("%s is no longer mounted on %s, mounting it again", volumeName, volumeInfo.MountPoint)
+	p.cancelIdleUnmount(volumeName)
+	// Only removes the directory if it is empty.
+	os.Remove(volumeInfo.MountPoint)
+	volumeInfo.reset()
+	return false
+}
+
+// resetStaleMounts resets the volumes with an idle timeout that were recorded
+// as mounted but are no longer mounted, which happens when the host was
+// rebooted or the mount was removed while the plugin was stopped.  Their
+// consumers are dropped as the containers will never unmount them.  Volumes
+// without an idle timeout are mounted per container and are left as is.
+func (p *Driver) resetStaleMounts() {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	tx, err := p.volumedb.Begin(true)
+	if err != nil {
+		log.Printf("unable to reset stale mounts: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	volumeMap, err := p.getVolumeMap(tx)
+	if err != nil {
+		log.Printf("unable to reset stale mounts: %s", err)
+		return
+	}
+	for name, info := range volumeMap {
+		if timeout, _ := idleTimeout(info.Options); timeout == 0 || info.MountPoint == "" || p.isMountPoint(info.MountPoint) {
+			continue
+		}
+		log.Printf("%s is no longer mounted on %s", name, info.MountPoint)
+		info.reset()
+		if err := p.storeVolumeInfo(tx, name, &info); err != nil {
+			log.Printf("unable to reset stale mount of %s: %s", name, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("unable to reset stale mounts: %s", err)
+	}
+}
@@ -0,0 +1,186 @@
+package mountedvolume
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	if d, err := idleTimeout(map[string]string{}); err != nil || d != 0 {
+		t.Errorf("expected no idle timeout got %s %v", d, err)
+	}
+	if d, err := idleTimeout(map[string]string{"idle_timeout": "10m"}); err != nil || d != 10*time.Minute {
+		t.Errorf("expected 10m got %s %v", d, err)
+	}
+	for _, value := range []string{"", "10", "-1m", "0s", "soon"} {
+		if _, err := idleTimeout(map[string]string{"idle_timeout": value}); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestIdleUnmount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("unmount requires root")
+	}
+	d := &testDriver{
+		Driver: *NewDriver("glusterfs", true, "idle1", "local"),
+	}
+	defer d.Close()
+	defer os.Remove("idle1.db")
+	d.Init(d)
+	// The temporary directory stands in for the mounted filesystem.
+	d.isMountPoint = func(string) bool { return true }
+
+	if err := d.Create(&volume.CreateRequest{
+		Name:    "test",
+		Options: map[string]string{"idle_timeout": "100ms"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate the volume being mounted by a container.
+	mountPoint, err := ioutil.TempDir("", "idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountPoint)
+	if err := d.volumedb.Update(func(tx *bolt.Tx) error {
+		info, _, err := d.getVolumeInfo(tx, "test")
+		if err != nil {
+			return err
+		}
+		info.mounted(mountPoint)
+		info.addConsumer("first")
+		return d.storeVolumeInfo(tx, "test", info)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := d.Mount(&volume.MountRequest{Name: "test", ID: "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Mountpoint != mountPoint {
+		t.Errorf("expected the mount point %s to be shared got %s", mountPoint, resp.Mountpoint)
+	}
+
+	if err := d.Unmount(&volume.UnmountRequest{Name: "test", ID: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Unmount(&volume.UnmountRequest{Name: "test", ID: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	get, _ := d.Get(&volume.GetRequest{Name: "test"})
+	if get.Volume.Status["mounted"] != true {
+		t.Error("expected the volume to remain mounted until the idle timeout")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	get, _ = d.Get(&volume.GetRequest{Name: "test"})
+	if get.Volume.Status["mounted"] != false {
+		t.Error("expected the volume to be unmounted after the idle timeout")
+	}
+	if _, err := os.Stat(mountPoint); !os.IsNotExist(err) {
+		t.Error("expected the mount point to be removed")
+	}
+}
+
+func TestMountPoints(t *testing.T) {
+	mountInfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+36 22 0:32 / /var/lib/docker-volumes/abc rw,relatime shared:2 - cifs //host/share rw
+37 22 0:33 / /mnt/with\040space rw,relatime - nfs server:/export rw
+`
+	points := mountPoints(mountInfo)
+	for _, expected := range []string{"/", "/var/lib/docker-volumes/abc", "/mnt/with space"} {
+		if !points[expected] {
+			t.Errorf("expected %s to be a mount point in %v", expected, points)
+		}
+	}
+	if points["/var/lib/docker-volumes"] {
+		t.Error("did not expect the parent to be a mount point")
+	}
+}
+
+func TestStaleMounts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mount requires root")
+	}
+	d := &testDriver{
+		Driver: *NewDriver("true", true, "idle2", "local"),
+	}
+	defer d.Close()
+	defer os.Remove("idle2.db")
+	d.isMountPoint = func(string) bool { return false }
+	d.Init(d)
+
+	for _, name := range []string{"stale", "shared"} {
+		if err := d.Create(&volume.CreateRequest{
+			Name:    name,
+			Options: map[string]string{"idle_timeout": "10m"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Create(&volume.CreateRequest{Name: "percontainer"}); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate the volumes being left mounted by containers that were never
+	// unmounted before the host was rebooted.
+	if err := d.volumedb.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"stale", "shared", "percontainer"} {
+			info, _, err := d.getVolumeInfo(tx, name)
+			if err != nil {
+				return err
+			}
+			info.mounted("/nonexistent/" + name)
+			info.addConsumer("crashed")
+			if err := d.storeVolumeInfo(tx, name, info); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	d.isMountPoint = func(mountPoint string) bool { return mountPoint == "/nonexistent/shared" }
+	d.Init(d)
+	get, _ := d.Get(&volume.GetRequest{Name: "stale"})
+	if get.Volume.Status["mounted"] != false || get.Volume.Status["consumers"] != 0 {
+		t.Errorf("expected the stale volume to be reset %v", get.Volume.Status)
+	}
+	get, _ = d.Get(&volume.GetRequest{Name: "shared"})
+	if get.Volume.Status["mounted"] != true || get.Volume.Status["consumers"] != 1 {
+		t.Errorf("expected the mounted volume to be kept %v", get.Volume.Status)
+	}
+	get, _ = d.Get(&volume.GetRequest{Name: "percontainer"})
+	if get.Volume.Status["mounted"] != true {
+		t.Errorf("expected the volume without idle timeout to be left as is %v", get.Volume.Status)
+	}
+
+	// The shared mount disappears while the plugin is running.
+	d.isMountPoint = func(string) bool { return false }
+	defer os.Remove(path.Join(volume.DefaultDockerRootDirectory, "idle2-container"))
+	resp, err := d.Mount(&volume.MountRequest{Name: "shared", ID: "idle2-container"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := path.Join(volume.DefaultDockerRootDirectory, "idle2-container"); resp.Mountpoint != expected {
+		t.Errorf("expected a fresh mount on %s got %s", expected, resp.Mountpoint)
+	}
+	d.volumedb.View(func(tx *bolt.Tx) error {
+		info, _, _ := d.getVolumeInfo(tx, "shared")
+		if !reflect.DeepEqual(info.Consumers, []string{"idle2-container"}) {
+			t.Errorf("expected the stale consumers to be dropped %v", info.Consumers)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,55 @@
+package mountedvolume
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// mountInfoFile lists the mounts visible to the plugin.
+const mountInfoFile = "/proc/self/mountinfo"
+
+// mountPoints parses the mount points from the content of a mountinfo file.
+func mountPoints(mountInfo string) map[string]bool {
+	points := make(map[string]bool)
+	for _, line := range strings.Split(mountInfo, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		points[unescapeMountInfo(fields[4])] = true
+	}
+	return points
+}
+
+// unescapeMountInfo decodes the octal escapes such as \040 that the kernel
+// uses for spaces and other special characters in mountinfo.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// isMountPoint returns true if the path is currently a mount point.  The path
+// is considered to be mounted if the mounts cannot be read so that volumes
+// are not remounted on top of themselves.
+func isMountPoint(path string) bool {
+	content, err := ioutil.ReadFile(mountInfoFile)
+	if err != nil {
+		return true
+	}
+	return mountPoints(string(content))[filepath.Clean(path)]
+}
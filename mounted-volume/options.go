@@ -0,0 +1,137 @@
+package mountedvolume
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Option is a single mount option.  Flags do not have a value.  An option
+// that is marked for removal is written as -key and removes the key when
+// merged into another list.
+type Option struct {
+	Key      string
+	Value    string
+	HasValue bool
+	Remove   bool
+}
+
+func (o Option) String() string {
+	if o.Remove {
+		return "-" + o.Key
+	}
+	if o.HasValue {
+		return o.Key + "=" + o.Value
+	}
+	return o.Key
+}
+
+// OptionList is an ordered list of mount options such as the value passed to
+// mount -o.  Keys are compared case insensitively.
+type OptionList []Option
+
+// ParseOptionList splits the comma separated options.  Empty elements are
+// ignored and an option that is specified more than once is rejected.
+func ParseOptionList(options string) (OptionList, error) {
+	var list OptionList
+	seen := make(map[string]bool)
+	for _, element := range strings.Split(options, ",") {
+		if element == "" {
+			continue
+		}
+		var opt Option
+		if strings.HasPrefix(element, "-") {
+			opt.Remove = true
+			element = element[1:]
+		}
+		parts := strings.SplitN(element, "=", 2)
+		opt.Key = parts[0]
+		if len(parts) == 2 {
+			if opt.Remove {
+				return nil, fmt.Errorf("-%s must not have a value", opt.Key)
+			}
+			opt.Value = parts[1]
+			opt.HasValue = true
+		}
+		if opt.Key == "" {
+			return nil, fmt.Errorf("%s does not have a key", element)
+		}
+		key := strings.ToLower(opt.Key)
+		if seen[key] {
+			return nil, fmt.Errorf("%s is specified more than once", opt.Key)
+		}
+		seen[key] = true
+		list = append(list, opt)
+	}
+	return list, nil
+}
+
+// MergeOptionLists parses the comma separated options and merges them in
+// order of increasing precedence.
+func MergeOptionLists(layers ...string) (OptionList, error) {
+	var merged OptionList
+	for _, layer := range layers {
+		list, err := ParseOptionList(layer)
+		if err != nil {
+			return nil, err
+		}
+		merged = merged.Merge(list)
+	}
+	return merged, nil
+}
+
+// index returns the position of the key in the list or -1.
+func (l OptionList) index(key string) int {
+	for i, opt := range l {
+		if strings.EqualFold(opt.Key, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get returns the option with the key.
+func (l OptionList) Get(key string) (Option, bool) {
+	if i := l.index(key); i != -1 {
+		return l[i], true
+	}
+	return Option{}, false
+}
+
+// Has returns true if the key is in the list.
+func (l OptionList) Has(key string) bool {
+	return l.index(key) != -1
+}
+
+// Merge returns a new list where the options of the other list replace the
+// options with the same key in place and are added at the end otherwise.
+// Options marked for removal in the other list remove the key.
+func (l OptionList) Merge(other OptionList) OptionList {
+	merged := append(OptionList{}, l...)
+	for _, opt := range other {
+		i := merged.index(opt.Key)
+		switch {
+		case opt.Remove && i != -1:
+			merged = append(merged[:i], merged[i+1:]...)
+		case opt.Remove:
+		case i != -1:
+			merged[i] = opt
+		default:
+			merged = append(merged, opt)
+		}
+	}
+	return merged
+}
+
+// Strings returns the options in their key=value form.
+func (l OptionList) Strings() []string {
+	var options []string
+	for _, opt := range l {
+		options = append(options, opt.String())
+	}
+	return options
+}
+
+// String returns the comma separated options.
+func (l OptionList) String() string {
+	return strings.Join(l.Strings(), ",")
+}
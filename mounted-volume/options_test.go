@@ -0,0 +1,67 @@
+package mountedvolume
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOptionList(t *testing.T) {
+	tests := []struct {
+		options  string
+		expected OptionList
+		valid    bool
+	}{
+		{"", nil, true},
+		{"hard,,nfsvers=4", OptionList{{Key: "hard"}, {Key: "nfsvers", Value: "4", HasValue: true}}, true},
+		{"-intr,prefix==x", OptionList{{Key: "intr", Remove: true}, {Key: "prefix", Value: "=x", HasValue: true}}, true},
+		{"vers=3.02,VERS=2.1", nil, false},
+		{"-vers=3.02", nil, false},
+		{"=x", nil, false},
+		{"-", nil, false},
+	}
+	for _, test := range tests {
+		list, err := ParseOptionList(test.options)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.options, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.options)
+		} else if test.valid && !reflect.DeepEqual(list, test.expected) {
+			t.Errorf("%s: %#v didn't match expected %#v", test.options, list, test.expected)
+		}
+	}
+}
+
+func TestMergeOptionLists(t *testing.T) {
+	tests := []struct {
+		layers   []string
+		expected string
+	}{
+		{[]string{"hard,proto=tcp,nfsvers=4,intr", ""}, "hard,proto=tcp,nfsvers=4,intr"},
+		{[]string{"hard,proto=tcp,nfsvers=4,intr", "nfsvers=4.1"}, "hard,proto=tcp,nfsvers=4.1,intr"},
+		{[]string{"hard,proto=tcp,nfsvers=4,intr", "-intr,-hard,soft"}, "proto=tcp,nfsvers=4,soft"},
+		{[]string{"hard", "-missing"}, "hard"},
+		{[]string{"", "ro"}, "ro"},
+		{[]string{"vers=3.02,mfsymlinks", "vers=2.1,nobrl", "VERS=3.0"}, "VERS=3.0,mfsymlinks,nobrl"},
+	}
+	for _, test := range tests {
+		merged, err := MergeOptionLists(test.layers...)
+		if err != nil {
+			t.Errorf("%v: unexpected error %s", test.layers, err)
+		} else if merged.String() != test.expected {
+			t.Errorf("%v: %s didn't match expected %s", test.layers, merged, test.expected)
+		}
+	}
+	if _, err := MergeOptionLists("hard", "ro,ro"); err == nil {
+		t.Error("expected duplicates within a layer to be rejected")
+	}
+
+	base := OptionList{{Key: "hard"}}
+	base.Merge(OptionList{{Key: "hard", Remove: true}})
+	if len(base) != 1 {
+		t.Error("expected Merge not to modify the list")
+	}
+	list := OptionList{{Key: "Vers", Value: "3", HasValue: true}}
+	if opt, ok := list.Get("vers"); !ok || opt.Value != "3" || !list.Has("VERS") {
+		t.Error("expected keys to be compared case insensitively")
+	}
+}
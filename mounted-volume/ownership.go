@@ -0,0 +1,85 @@
+package mountedvolume
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// OwnershipMapper may be implemented by a DriverCallback for filesystems
+// where changing the owner of the mount root is not meaningful.  The callback
+// is expected to translate the uid, gid and mode options into mount options
+// instead, in which case the Driver will not apply them after the mount.
+type OwnershipMapper interface {
+	MapsOwnership() bool
+}
+
+// Ownership holds the uid, gid and mode driver options.  A negative value
+// indicates that the option was not specified.
+type Ownership struct {
+	UID  int
+	GID  int
+	Mode int
+}
+
+// ParseOwnership parses the uid, gid and mode driver options.  The mode is
+// expected to be in octal.
+func ParseOwnership(options map[string]string) (Ownership, error) {
+	o := Ownership{UID: -1, GID: -1, Mode: -1}
+	if uid, ok := options["uid"]; ok {
+		v, err := strconv.Atoi(uid)
+		if err != nil || v < 0 {
+			return o, fmt.Errorf("uid must be a non-negative integer: %s", uid)
+		}
+		o.UID = v
+	}
+	if gid, ok := options["gid"]; ok {
+		v, err := strconv.Atoi(gid)
+		if err != nil || v < 0 {
+			return o, fmt.Errorf("gid must be a non-negative integer: %s", gid)
+		}
+		o.GID = v
+	}
+	if mode, ok := options["mode"]; ok {
+		v, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || v > 07777 {
+			return o, fmt.Errorf("mode must be an octal value between 0 and 7777: %s", mode)
+		}
+		o.Mode = int(v)
+	}
+	return o, nil
+}
+
+// IsSet returns true if any of the options were specified.
+func (o Ownership) IsSet() bool {
+	return o.UID >= 0 || o.GID >= 0 || o.Mode >= 0
+}
+
+// apply changes the owner and mode of the path.
+func (o Ownership) apply(path string) error {
+	if o.UID >= 0 || o.GID >= 0 {
+		if err := os.Chown(path, o.UID, o.GID); err != nil {
+			return err
+		}
+	}
+	if o.Mode >= 0 {
+		return os.Chmod(path, os.FileMode(o.Mode&0777)|modeSpecialBits(o.Mode))
+	}
+	return nil
+}
+
+// modeSpecialBits maps the setuid, setgid and sticky bits from the octal
+// mode to their os.FileMode equivalents.
+func modeSpecialBits(mode int) os.FileMode {
+	var m os.FileMode
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
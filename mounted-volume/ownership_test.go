@@ -0,0 +1,54 @@
+package mountedvolume
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseOwnership(t *testing.T) {
+	tests := []struct {
+		options  map[string]string
+		expected Ownership
+		valid    bool
+	}{
+		{map[string]string{}, Ownership{-1, -1, -1}, true},
+		{map[string]string{"uid": "1000", "gid": "100"}, Ownership{1000, 100, -1}, true},
+		{map[string]string{"mode": "0775"}, Ownership{-1, -1, 0775}, true},
+		{map[string]string{"mode": "1777"}, Ownership{-1, -1, 01777}, true},
+		{map[string]string{"uid": "-1"}, Ownership{}, false},
+		{map[string]string{"gid": "staff"}, Ownership{}, false},
+		{map[string]string{"mode": "0778"}, Ownership{}, false},
+		{map[string]string{"mode": "17777"}, Ownership{}, false},
+	}
+	for _, test := range tests {
+		o, err := ParseOwnership(test.options)
+		if test.valid && err != nil {
+			t.Errorf("%v: unexpected error %s", test.options, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%v: expected an error", test.options)
+		} else if test.valid && o != test.expected {
+			t.Errorf("%v: %v didn't match expected %v", test.options, o, test.expected)
+		}
+	}
+}
+
+func TestApplyOwnership(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ownership")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := Ownership{UID: os.Getuid(), GID: os.Getgid(), Mode: 01770}
+	if err := o.apply(dir); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0770 || fi.Mode()&os.ModeSticky == 0 {
+		t.Errorf("unexpected mode %s", fi.Mode())
+	}
+}
@@ -7,9 +7,14 @@ import (
 
 // HideRoot hides the root folder by performing a mount of a tmpfs on top of the /root folder.
 func HideRoot() error {
-	err := syscall.Mount("tmpfs", "/root", "tmpfs", syscall.MS_RDONLY|syscall.MS_NOEXEC|syscall.MS_NOSUID|syscall.MS_NODEV, "size=1m")
+	return HidePath("/root")
+}
+
+// HidePath hides the folder by performing a mount of a tmpfs on top of it.
+func HidePath(path string) error {
+	err := syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_RDONLY|syscall.MS_NOEXEC|syscall.MS_NOSUID|syscall.MS_NODEV, "size=1m")
 	if err != nil {
-		log.Printf("unable to hide /root: %s", err)
+		log.Printf("unable to hide %s: %s", path, err)
 	}
 	return err
 }
@@ -0,0 +1,206 @@
+package mountedvolume
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// SubdirCreator may be implemented by a DriverCallback whose volumes can
+// refer to a subdirectory of the remote filesystem.  When CREATE_SUBDIR is
+// enabled the parent is mounted in a private staging directory so the
+// subdirectory can be created before the actual mount takes place.
+type SubdirCreator interface {
+	// ParentMountArgs derives the mount arguments for the parent filesystem
+	// from the arguments that were generated by MountOptions along with the
+	// subdirectory path relative to it.  An empty subdirectory indicates
+	// that the volume does not refer to a subdirectory.
+	ParentMountArgs(args []string) (parentArgs []string, subdir string)
+}
+
+// ValidateSubdir checks that the subdirectory is a relative path without
+// empty, . or .. segments so it cannot refer to a path outside of the
+// filesystem it is in.
+func ValidateSubdir(subdir string) error {
+	if strings.HasPrefix(subdir, "/") {
+		return fmt.Errorf("the subdirectory %s must be relative", subdir)
+	}
+	for _, segment := range strings.Split(subdir, "/") {
+		switch segment {
+		case "":
+			return fmt.Errorf("the subdirectory %s must not contain empty path segments", subdir)
+		case ".", "..":
+			return fmt.Errorf("the subdirectory %s must not contain %s", subdir, segment)
+		}
+	}
+	return nil
+}
+
+type subdirConfig struct {
+	create bool
+	mode   os.FileMode
+	uid    int
+	gid    int
+}
+
+// subdirConfigFromEnv reads CREATE_SUBDIR, SUBDIR_MODE, SUBDIR_UID and
+// SUBDIR_GID.  A blank uid or gid leaves the ownership as is.
+func subdirConfigFromEnv() subdirConfig {
+	c := subdirConfig{
+		create: os.Getenv("CREATE_SUBDIR") == "true",
+		mode:   0755,
+		uid:    -1,
+		gid:    -1,
+	}
+	if mode := os.Getenv("SUBDIR_MODE"); mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			log.Printf("invalid SUBDIR_MODE %s, using %o", mode, c.mode)
+		} else {
+			c.mode = os.FileMode(m)
+		}
+	}
+	if uid := os.Getenv("SUBDIR_UID"); uid != "" {
+		if v, err := strconv.Atoi(uid); err != nil {
+			log.Printf("invalid SUBDIR_UID %s, ignoring", uid)
+		} else {
+			c.uid = v
+		}
+	}
+	if gid := os.Getenv("SUBDIR_GID"); gid != "" {
+		if v, err := strconv.Atoi(gid); err != nil {
+			log.Printf("invalid SUBDIR_GID %s, ignoring", gid)
+		} else {
+			c.gid = v
+		}
+	}
+	return c
+}
+
+// mkdirAll creates the missing directories of the subdirectory in root one
+// segment at a time.  Symbolic links are rejected as they could resolve to a
+// path outside of root, and every directory that is created gets the
+// configured mode and ownership.
+func (c subdirConfig) mkdirAll(root, subdir, volumeName string) error {
+	path := root
+	for _, segment := range strings.Split(subdir, "/") {
+		path = filepath.Join(path, segment)
+		rel := strings.TrimPrefix(path, root+string(filepath.Separator))
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			log.Printf("creating subdirectory %s for %s", rel, volumeName)
+			if err := os.Mkdir(path, c.mode); err != nil {
+				return err
+			}
+			if err := c.apply(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("the subdirectory %s of %s is a symbolic link", rel, volumeName)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("the subdirectory %s of %s is not a directory", rel, volumeName)
+		}
+	}
+	return nil
+}
+
+// apply sets the mode and ownership of a directory that was just created.
+// Mkdir is subject to the umask so the mode is set explicitly.
+func (c subdirConfig) apply(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s was replaced while it was created", path)
+	}
+	if err := os.Chmod(path, c.mode); err != nil {
+		return err
+	}
+	if c.uid >= 0 || c.gid >= 0 {
+		return os.Lchown(path, c.uid, c.gid)
+	}
+	return nil
+}
+
+// createSubdir mounts the parent of the volume in a staging directory and
+// creates the subdirectory if it does not exist yet.  If the parent cannot
+// be mounted the alternatives provided by MountFallback are tried and the
+// volume arguments that worked are returned so the actual mount uses them.
+func (p *Driver) createSubdir(req *volume.MountRequest, args []string, env []string) ([]string, error) {
+	if !p.subdir.create {
+		return args, nil
+	}
+	creator, ok := p.DriverCallback.(SubdirCreator)
+	if !ok {
+		return args, nil
+	}
+	parentArgs, subdir := creator.ParentMountArgs(args)
+	if subdir == "" {
+		return args, nil
+	}
+	if err := ValidateSubdir(subdir); err != nil {
+		return nil, err
+	}
+
+	staging, err := ioutil.TempDir("", "subdir")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(staging)
+
+	if out, err := p.mountWithArgs(req, parentArgs, staging, env); err != nil {
+		log.Printf("Command output: %s\n", out)
+		if args, err = p.mountParentFallback(req, args, out, staging, env); err != nil {
+			return nil, fmt.Errorf("unable to mount parent of %s: %s", req.Name, err.Error())
+		}
+	}
+	defer func() {
+		if err := syscall.Unmount(staging, 0); err != nil {
+			log.Printf("error unmounting staging directory %s: %s", staging, err)
+		}
+	}()
+
+	target := filepath.Join(staging, subdir)
+	if !strings.HasPrefix(target, staging+string(filepath.Separator)) {
+		return nil, fmt.Errorf("the subdirectory %s is outside of the parent of %s", subdir, req.Name)
+	}
+	if err := p.subdir.mkdirAll(staging, subdir, req.Name); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// mountParentFallback mounts the parent using the alternatives provided by
+// MountFallback for the volume arguments and returns the volume arguments
+// whose parent mounted successfully.
+func (p *Driver) mountParentFallback(req *volume.MountRequest, args []string, output []byte, staging string, env []string) ([]string, error) {
+	fallback, ok := p.DriverCallback.(MountFallback)
+	if !ok {
+		return nil, fmt.Errorf("no fallback available")
+	}
+	creator := p.DriverCallback.(SubdirCreator)
+	for _, candidate := range fallback.FallbackArgs(args, output) {
+		parentArgs, _ := creator.ParentMountArgs(candidate)
+		out, err := p.mountWithArgs(req, parentArgs, staging, env)
+		if err == nil {
+			log.Printf("mounted parent of %s using fallback %v", req.Name, parentArgs)
+			return candidate, nil
+		}
+		log.Printf("Command output: %s\n", out)
+	}
+	return nil, fmt.Errorf("no fallback succeeded")
+}
@@ -0,0 +1,66 @@
+package mountedvolume
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateSubdir(t *testing.T) {
+	tests := map[string]bool{
+		"level1":           true,
+		"level1/level2":    true,
+		"..":               false,
+		"level1/../../etc": false,
+		"level1/./level2":  false,
+		"level1//level2":   false,
+		"/var/lib/docker":  false,
+		"":                 false,
+	}
+	for subdir, valid := range tests {
+		if err := ValidateSubdir(subdir); (err == nil) != valid {
+			t.Errorf("ValidateSubdir(%q) error %v, expected valid %v", subdir, err, valid)
+		}
+	}
+}
+
+func TestSubdirMkdirAll(t *testing.T) {
+	root, err := ioutil.TempDir("", "subdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	c := subdirConfig{create: true, mode: 0750, uid: -1, gid: -1}
+
+	if err := c.mkdirAll(root, "level1/level2", "vol"); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"level1", "level1/level2"} {
+		info, err := os.Stat(filepath.Join(root, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0750 {
+			t.Errorf("%s has mode %o, expected 750", dir, info.Mode().Perm())
+		}
+	}
+	if err := c.mkdirAll(root, "level1/level2", "vol"); err != nil {
+		t.Errorf("existing subdirectory: %s", err)
+	}
+
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.mkdirAll(root, "link/escaped", "vol"); err == nil {
+		t.Error("expected symbolic link to be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("directory was created outside of the root: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// hostnameLabel matches a single label of a DNS hostname.
+var hostnameLabel = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// nfsDevice is the server and export path of an NFS device given as
+// host:/path with IPv6 addresses enclosed in brackets.
+type nfsDevice struct {
+	host string
+	path string
+}
+
+// parseDevice parses an NFS device such as server1:/export, 192.168.1.1:/export
+// or [fe80::1]:/export.  IPv6 addresses that are not enclosed in brackets are
+// rejected as the separator between the server and the path is ambiguous.
+func parseDevice(device string) (nfsDevice, error) {
+	var host, rest string
+	if strings.HasPrefix(device, "[") {
+		end := strings.Index(device, "]")
+		if end == -1 {
+			return nfsDevice{}, fmt.Errorf("the device %s is missing the closing bracket of the IPv6 address", device)
+		}
+		host = device[1:end]
+		if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+			return nfsDevice{}, fmt.Errorf("the device %s must only enclose IPv6 addresses in brackets", device)
+		}
+		if !strings.HasPrefix(device[end+1:], ":") {
+			return nfsDevice{}, fmt.Errorf("the device %s must be of the form [address]:/path", device)
+		}
+		rest = device[end+2:]
+	} else {
+		i := strings.Index(device, ":")
+		if i == -1 {
+			return nfsDevice{}, fmt.Errorf("the device %s must be of the form server:/path", device)
+		}
+		host, rest = device[:i], device[i+1:]
+		if strings.Contains(rest, ":") && !strings.HasPrefix(rest, "/") {
+			return nfsDevice{}, fmt.Errorf("the IPv6 address in the device %s must be enclosed in brackets", device)
+		}
+		if err := validateHost(host); err != nil {
+			return nfsDevice{}, fmt.Errorf("the device %s has an invalid server: %s", device, err)
+		}
+	}
+	if !strings.HasPrefix(rest, "/") {
+		return nfsDevice{}, fmt.Errorf("the export path of the device %s must be absolute", device)
+	}
+	for _, segment := range strings.Split(rest, "/") {
+		if segment == ".." {
+			return nfsDevice{}, fmt.Errorf("the export path of the device %s must not contain ..", device)
+		}
+	}
+	if strings.ContainsAny(rest, "\x00\n") {
+		return nfsDevice{}, fmt.Errorf("the export path of the device %s contains invalid characters", device)
+	}
+	return nfsDevice{host: host, path: rest}, nil
+}
+
+// validateHost checks the server is an IPv4 address or a hostname.
+func validateHost(host string) error {
+	if host == "" {
+		return fmt.Errorf("the server is empty")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() == nil {
+			return fmt.Errorf("the IPv6 address %s must be enclosed in brackets", host)
+		}
+		return nil
+	}
+	if len(host) > 253 {
+		return fmt.Errorf("the hostname %s is too long", host)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if !hostnameLabel.MatchString(label) {
+			return fmt.Errorf("%s is not a valid hostname", host)
+		}
+	}
+	return nil
+}
+
+// validateServer checks NFS_SERVER is a single server which may be an IPv6
+// address with or without brackets.
+func validateServer(server string) error {
+	if strings.ContainsAny(server, ", ") {
+		return fmt.Errorf("only one server is supported, use a separate plugin alias for each server: %s", server)
+	}
+	if ip := net.ParseIP(strings.Trim(server, "[]")); ip != nil {
+		return nil
+	}
+	return validateHost(server)
+}
+
+// String returns the device as passed to mount.
+func (d nfsDevice) String() string {
+	if strings.Contains(d.host, ":") {
+		return "[" + d.host + "]:" + d.path
+	}
+	return d.host + ":" + d.path
+}
+
+// parent returns the device of the parent directory and the last element of
+// the export path.  Exports that are directly below the root have no parent.
+func (d nfsDevice) parent() (nfsDevice, string, bool) {
+	exportPath := path.Clean(d.path)
+	parent := path.Dir(exportPath)
+	if parent == "/" {
+		return nfsDevice{}, "", false
+	}
+	return nfsDevice{host: d.host, path: parent}, path.Base(exportPath), true
+}
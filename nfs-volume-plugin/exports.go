@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exportCache queries the export lists of the NFS servers using showmount
+// and keeps them for the configured time so creating many volumes on the
+// same server does not query it each time.
+type exportCache struct {
+	showmount string
+	timeout   time.Duration
+	ttl       time.Duration
+	entries   map[string]exportList
+	m         sync.Mutex
+}
+
+// exportList is the export list of a server and when it was retrieved.
+type exportList struct {
+	exports   []string
+	fetchedAt time.Time
+}
+
+func newExportCache(showmount string, timeout, ttl time.Duration) *exportCache {
+	return &exportCache{
+		showmount: showmount,
+		timeout:   timeout,
+		ttl:       ttl,
+		entries:   make(map[string]exportList),
+	}
+}
+
+// errUnknownHost is returned by exports when the server name cannot be
+// resolved.
+var errUnknownHost = errors.New("unknown host")
+
+// exports returns the export list of the server.  Failures to query the
+// server are not cached.  The lock is not held while showmount runs so a slow
+// server does not hold up the checks of the other servers.
+func (c *exportCache) exports(host string) ([]string, error) {
+	c.m.Lock()
+	entry, ok := c.entries[host]
+	c.m.Unlock()
+	if ok && time.Since(entry.fetchedAt) < c.ttl {
+		return entry.exports, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, c.showmount, "-e", "--no-headers", host).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("unable to list the exports of %s: timed out after %s", host, c.timeout)
+	}
+	if strings.Contains(string(out), "Unknown host") {
+		return nil, errUnknownHost
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the exports of %s: %s: %s", host, err, strings.TrimSpace(string(out)))
+	}
+	exports := parseExports(string(out))
+	c.m.Lock()
+	c.entries[host] = exportList{exports: exports, fetchedAt: time.Now()}
+	c.m.Unlock()
+	return exports, nil
+}
+
+// validate checks the export path of the device is offered by its server.
+// Servers whose mountd cannot be reached, such as servers that only offer
+// NFSv4, are not checked.
+func (c *exportCache) validate(device nfsDevice) error {
+	exports, err := c.exports(device.host)
+	if err == errUnknownHost {
+		return fmt.Errorf("the server %s is not known", device.host)
+	}
+	if err != nil {
+		log.Printf("not checking the export %s: %s", device.path, err)
+		return nil
+	}
+	if !exportOffered(exports, device.path) {
+		return fmt.Errorf("the export %s is not offered by %s, the exports are %s", device.path, device.host, strings.Join(exports, ", "))
+	}
+	return nil
+}
+
+// parseExports parses the output of showmount -e and returns the exported
+// paths.  The header is skipped in case the option to omit it is ignored.
+func parseExports(showmountOutput string) []string {
+	var exports []string
+	for _, line := range strings.Split(showmountOutput, "\n") {
+		if strings.HasPrefix(line, "Export list for") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+			continue
+		}
+		exports = append(exports, fields[0])
+	}
+	return exports
+}
+
+// exportOffered returns true if the path is one of the exports or a
+// directory within one of them.  As the path may be relative to an NFSv4
+// pseudo root that showmount does not report, it is also looked up relative to
+// the parent directories of each export.
+func exportOffered(exports []string, exportPath string) bool {
+	exportPath = path.Clean(exportPath)
+	for _, export := range exports {
+		export = path.Clean(export)
+		for root := export; root != "/"; {
+			root = path.Dir(root)
+			if pathWithin(path.Join(root, exportPath), export) {
+				return true
+			}
+		}
+		if export == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// pathWithin returns true if the path is the directory or within it.
+func pathWithin(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
@@ -1,9 +1,53 @@
 #!/bin/sh -e
-echo DEFAULT_NFSOPTS=${DEFAULT_NFSOPTS} >> /pluginenv
+# pluginenv writes the variables to the EnvironmentFile of the plugin service.
+# The values are double quoted with \ " ` and $ escaped so systemd reads them
+# back unchanged.
+pluginenv() {
+  for name in "$@"
+  do
+    eval "value=\${${name}}"
+    printf '%s="%s"\n' "${name}" "$(printf '%s' "${value}" | sed 's/[\\"`$]/\\&/g')" >> /pluginenv
+  done
+}
+pluginenv DEFAULT_NFSOPTS \
+  NFS_SERVER \
+  VERS_FALLBACK \
+  KERBEROS \
+  EXPORT_CHECK \
+  EXPORT_CHECK_TIMEOUT \
+  EXPORT_CACHE_TTL \
+  PREMOUNT_HOOK \
+  PREMOUNT_HOOK_TIMEOUT \
+  PREMOUNT_HOOK_FAILURE \
+  POSTMOUNT_HOOK \
+  POSTMOUNT_HOOK_TIMEOUT \
+  POSTMOUNT_HOOK_FAILURE \
+  PREUNMOUNT_HOOK \
+  PREUNMOUNT_HOOK_TIMEOUT \
+  PREUNMOUNT_HOOK_FAILURE \
+  CREATE_SUBDIR \
+  SUBDIR_MODE \
+  SUBDIR_UID \
+  SUBDIR_GID
 mkdir -p /dockerplugins
 if [ -e /run/docker/plugins ]
 then
   mount --bind /run/docker/plugins /dockerplugins
 fi
 mount --rbind /hostcgroup /sys/fs/cgroup
+if [ "${KERBEROS}" = "true" ]
+then
+  # rpc.gssd uses the machine credentials in /etc/krb5.keytab
+  if [ -f /krb5/krb5.conf ]
+  then
+    cp /krb5/krb5.conf /etc/krb5.conf
+  fi
+  if [ -f "/krb5/${KRB5_KEYTAB}" ]
+  then
+    install -m 600 "/krb5/${KRB5_KEYTAB}" /etc/krb5.keytab
+  else
+    echo "keytab /krb5/${KRB5_KEYTAB} not found, sec=krb5 volumes cannot be mounted"
+  fi
+  ln -sf /usr/lib/systemd/system/rpc-gssd.service /etc/systemd/system/multi-user.target.wants/rpc-gssd.service
+fi
 exec /sbin/init
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/trajano/docker-volume-plugins/mounted-volume"
+)
+
+// defaultKeytab is where init.sh copies the keytab from the krb5 mount as
+// that is where rpc.gssd looks for the machine credentials.
+const defaultKeytab = "/etc/krb5.keytab"
+
+// krb5Directory is where the krb5 mount is.  It is hidden once init.sh has
+// copied the files.
+const krb5Directory = "/krb5"
+
+// gssdServices are the services of the machine principals that rpc.gssd
+// uses to establish the security context.
+var gssdServices = []string{"root/", "nfs/", "host/"}
+
+// isKerberos returns true if the sec option requests any of the Kerberos
+// flavors krb5, krb5i or krb5p.
+func isKerberos(options mountedvolume.OptionList) bool {
+	sec, ok := options.Get("sec")
+	if !ok {
+		return false
+	}
+	for _, flavor := range strings.Split(sec.Value, ":") {
+		if strings.HasPrefix(flavor, "krb5") {
+			return true
+		}
+	}
+	return false
+}
+
+// optionsFromArgs extracts the options from the mount arguments.
+func optionsFromArgs(args []string) mountedvolume.OptionList {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-o" {
+			options, _ := mountedvolume.ParseOptionList(args[i+1])
+			return options
+		}
+	}
+	return nil
+}
+
+// validateKerberos checks that Kerberos is enabled and the keytab contains a
+// principal that rpc.gssd can use.
+func (p *nfsDriver) validateKerberos() error {
+	if !p.kerberos {
+		return fmt.Errorf("sec=krb5 requires the plugin to be configured with KERBEROS=true")
+	}
+	if _, err := os.Stat(p.keytab); err != nil {
+		return fmt.Errorf("sec=krb5 requires the keytab %s, check KRB5_KEYTAB and the source of the krb5 mount: %s", p.keytab, err)
+	}
+	out, err := exec.Command("klist", "-k", p.keytab).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unable to read keytab %s: %s: %s", p.keytab, err, strings.TrimSpace(string(out)))
+	}
+	principals := keytabPrincipals(string(out))
+	if len(principals) == 0 {
+		return fmt.Errorf("the keytab %s has no principals", p.keytab)
+	}
+	if machinePrincipal(principals) == "" {
+		return fmt.Errorf("the keytab %s has no root/, nfs/ or host/ principal for rpc.gssd, found %s", p.keytab, strings.Join(principals, ", "))
+	}
+	return nil
+}
+
+// MountEnv checks that rpc.gssd is running before a volume is mounted with
+// sec=krb5 as the kernel otherwise reports an unhelpful error.
+func (p *nfsDriver) MountEnv(req *volume.MountRequest, args []string) ([]string, error) {
+	if !isKerberos(optionsFromArgs(args)) {
+		return nil, nil
+	}
+	if err := p.validateKerberos(); err != nil {
+		return nil, err
+	}
+	if !processRunning("rpc.gssd") {
+		return nil, fmt.Errorf("rpc.gssd is not running, check the keytab %s and the plugin log", p.keytab)
+	}
+	return nil, nil
+}
+
+// keytabPrincipals parses the output of klist -k and returns the distinct
+// principals in the order they are listed.
+func keytabPrincipals(klistOutput string) []string {
+	var principals []string
+	seen := make(map[string]bool)
+	entries := false
+	for _, line := range strings.Split(klistOutput, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "----") {
+			entries = true
+		} else if entries && len(fields) >= 2 && !seen[fields[1]] {
+			seen[fields[1]] = true
+			principals = append(principals, fields[1])
+		}
+	}
+	return principals
+}
+
+// machinePrincipal returns the first principal that rpc.gssd can use which
+// is either a service principal in gssdServices or an Active Directory
+// machine account ending with $.
+func machinePrincipal(principals []string) string {
+	for _, principal := range principals {
+		if strings.Contains(principal, "$@") {
+			return principal
+		}
+		for _, service := range gssdServices {
+			if strings.HasPrefix(principal, service) {
+				return principal
+			}
+		}
+	}
+	return ""
+}
+
+// processRunning returns true if a process with the command name exists.
+func processRunning(name string) bool {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return false
+	}
+	for _, dir := range dirs {
+		comm, err := ioutil.ReadFile(filepath.Join("/proc", dir.Name(), "comm"))
+		if err == nil && strings.TrimSpace(string(comm)) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/docker/go-connections/sockets"
 	"github.com/docker/go-plugins-helpers/volume"
@@ -14,6 +15,11 @@ import (
 
 type nfsDriver struct {
 	defaultOptions string
+	server         string
+	versFallback   []string
+	kerberos       bool
+	keytab         string
+	exports        *exportCache
 	mountedvolume.Driver
 }
 
@@ -21,25 +27,86 @@ func (p *nfsDriver) Validate(req *volume.CreateRequest) error {
 
 	_, deviceDefinedInOpts := req.Options["device"]
 
-	if !deviceDefinedInOpts {
+	nfsOptions, err := mountedvolume.MergeOptionLists(p.defaultOptions, req.Options["nfsopts"])
+	if err != nil {
+		return fmt.Errorf("invalid nfsopts: %s", err)
+	}
+	if isKerberos(nfsOptions) {
+		if err := p.validateKerberos(); err != nil {
+			return err
+		}
+	}
+
+	if p.server != "" {
+		if deviceDefinedInOpts {
+			return fmt.Errorf("NFS_SERVER is set, device is not allowed")
+		}
+		if _, err := exportPath(req.Name); err != nil {
+			return err
+		}
+	} else if !deviceDefinedInOpts {
 		return fmt.Errorf("device is required in driver_opts")
 	}
 
-	return nil
+	_, err = parseDevice(p.device(req))
+	return err
 }
 
-func (p *nfsDriver) MountOptions(req *volume.CreateRequest) []string {
+// CheckCreate checks the export is offered by the server when EXPORT_CHECK
+// is enabled.  Malformed requests are left for Validate to report.
+func (p *nfsDriver) CheckCreate(req *volume.CreateRequest) error {
+	if p.exports == nil {
+		return nil
+	}
+	if p.server == "" {
+		if _, deviceDefinedInOpts := req.Options["device"]; !deviceDefinedInOpts {
+			return nil
+		}
+	} else if _, err := exportPath(req.Name); err != nil {
+		return nil
+	}
+	device, err := parseDevice(p.device(req))
+	if err != nil {
+		return nil
+	}
+	return p.exports.validate(device)
+}
 
-	nfsOptions, nfsoptsInOpts := req.Options["nfsopts"]
+// exportPath maps the volume name export/subpath to the absolute path on the
+// server.  Names that start with a slash or contain empty, . or .. segments
+// are rejected.
+func exportPath(volumeName string) (string, error) {
+	if volumeName == "" || strings.HasPrefix(volumeName, "/") {
+		return "", fmt.Errorf("the volume name %s must be of the form export/subpath", volumeName)
+	}
+	for _, segment := range strings.Split(volumeName, "/") {
+		switch segment {
+		case "":
+			return "", fmt.Errorf("the volume name %s must not contain empty path segments", volumeName)
+		case ".", "..":
+			return "", fmt.Errorf("the volume name %s must not contain %s", volumeName, segment)
+		}
+	}
+	return "/" + volumeName, nil
+}
 
-	var nfsOptionsArray []string
-	if nfsoptsInOpts {
-		nfsOptionsArray = append(nfsOptionsArray, strings.Split(nfsOptions, ",")...)
-	} else {
-		nfsOptionsArray = append(nfsOptionsArray, strings.Split(p.defaultOptions, ",")...)
+// device returns the device for the volume which is either driver_opts.device
+// or the export on NFS_SERVER given by the name.
+func (p *nfsDriver) device(req *volume.CreateRequest) string {
+	if p.server == "" {
+		return req.Options["device"]
 	}
+	exportPath, _ := exportPath(req.Name)
+	return nfsDevice{host: strings.Trim(p.server, "[]"), path: exportPath}.String()
+}
+
+func (p *nfsDriver) MountOptions(req *volume.CreateRequest) []string {
 
-	return []string{"-t", "nfs", "-o", strings.Join(nfsOptionsArray, ","), req.Options["device"]}
+	// driver_opts.nfsopts is merged into DEFAULT_NFSOPTS, the options are
+	// checked by Validate.
+	nfsOptions, _ := mountedvolume.MergeOptionLists(p.defaultOptions, req.Options["nfsopts"])
+
+	return []string{"-t", "nfs", "-o", nfsOptions.String(), p.device(req)}
 
 }
 
@@ -50,12 +117,58 @@ func (p *nfsDriver) PreMount(req *volume.MountRequest) error {
 func (p *nfsDriver) PostMount(req *volume.MountRequest) {
 }
 
+// ParentMountArgs mounts the parent directory of the device path so the last
+// element of the path can be created.  Devices that are directly below the
+// root are not considered to be subdirectories.
+func (p *nfsDriver) ParentMountArgs(args []string) ([]string, string) {
+	device, err := parseDevice(args[len(args)-1])
+	if err != nil {
+		return nil, ""
+	}
+	parent, subdir, ok := device.parent()
+	if !ok {
+		return nil, ""
+	}
+	parentArgs := append([]string{}, args[:len(args)-1]...)
+	return append(parentArgs, parent.String()), subdir
+}
+
 func buildDriver() *nfsDriver {
+	var versFallback []string
+	for _, vers := range strings.Split(os.Getenv("VERS_FALLBACK"), ",") {
+		if vers = strings.TrimSpace(vers); vers != "" {
+			versFallback = append(versFallback, vers)
+		}
+	}
+	server := os.Getenv("NFS_SERVER")
+	if server != "" {
+		if err := validateServer(server); err != nil {
+			log.Fatalf("invalid NFS_SERVER: %s", err)
+		}
+	}
+	var exports *exportCache
+	if os.Getenv("EXPORT_CHECK") == "true" {
+		timeout, err := time.ParseDuration(os.Getenv("EXPORT_CHECK_TIMEOUT"))
+		if err != nil || timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		ttl, err := time.ParseDuration(os.Getenv("EXPORT_CACHE_TTL"))
+		if err != nil || ttl < 0 {
+			ttl = time.Minute
+		}
+		exports = newExportCache("showmount", timeout, ttl)
+	}
 	d := &nfsDriver{
 		Driver:         *mountedvolume.NewDriver("mount", true, "nfs", "local"),
 		defaultOptions: os.Getenv("DEFAULT_NFSOPTS"),
+		server:         server,
+		versFallback:   versFallback,
+		kerberos:       os.Getenv("KERBEROS") == "true",
+		keytab:         defaultKeytab,
+		exports:        exports,
 	}
 	d.Init(d)
+	mountedvolume.HidePath(krb5Directory)
 	return d
 }
 
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/trajano/docker-volume-plugins/mounted-volume"
+)
+
+func TestParseDevice(t *testing.T) {
+	tests := []struct {
+		device   string
+		expected nfsDevice
+		valid    bool
+	}{
+		{"server1:/share_name", nfsDevice{"server1", "/share_name"}, true},
+		{"nas.example.com:/export/app", nfsDevice{"nas.example.com", "/export/app"}, true},
+		{"192.168.1.1:/mnt/routerdrive/nfs", nfsDevice{"192.168.1.1", "/mnt/routerdrive/nfs"}, true},
+		{"[fe80::1]:/export", nfsDevice{"fe80::1", "/export"}, true},
+		{"[2001:db8::2]:/", nfsDevice{"2001:db8::2", "/"}, true},
+		{"server1", nfsDevice{}, false},
+		{":/export", nfsDevice{}, false},
+		{"server1:export", nfsDevice{}, false},
+		{"server1:/export/../etc", nfsDevice{}, false},
+		{"fe80::1:/export", nfsDevice{}, false},
+		{"[fe80::1:/export", nfsDevice{}, false},
+		{"[192.168.1.1]:/export", nfsDevice{}, false},
+		{"[fe80::1]/export", nfsDevice{}, false},
+		{"bad_host:/export", nfsDevice{}, false},
+		{"-server:/export", nfsDevice{}, false},
+		{"server 1:/export", nfsDevice{}, false},
+	}
+	for _, test := range tests {
+		device, err := parseDevice(test.device)
+		if (err == nil) != test.valid {
+			t.Errorf("parseDevice(%q) error %v, expected valid %v", test.device, err, test.valid)
+			continue
+		}
+		if test.valid && device != test.expected {
+			t.Errorf("parseDevice(%q) = %v, expected %v", test.device, device, test.expected)
+		}
+		if test.valid && device.String() != test.device {
+			t.Errorf("%v formatted as %s, expected %s", device, device.String(), test.device)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	d := &nfsDriver{defaultOptions: "hard,proto=tcp"}
+	tests := []struct {
+		options map[string]string
+		valid   bool
+	}{
+		{map[string]string{"device": "server1:/share_name"}, true},
+		{map[string]string{"device": "[fe80::1]:/share_name"}, true},
+		{map[string]string{}, false},
+		{map[string]string{"device": "server1"}, false},
+		{map[string]string{"device": "fe80::1:/share_name"}, false},
+		{map[string]string{"device": "server1:/share_name", "nfsopts": "ro,ro"}, false},
+	}
+	for _, test := range tests {
+		err := d.Validate(&volume.CreateRequest{Name: "sample", Options: test.options})
+		if (err == nil) != test.valid {
+			t.Errorf("Validate(%v) error %v, expected valid %v", test.options, err, test.valid)
+		}
+	}
+
+	d.server = "fe80::1"
+	req := &volume.CreateRequest{Name: "share_name/app", Options: map[string]string{}}
+	if err := d.Validate(req); err != nil {
+		t.Error(err)
+	}
+	if device := d.device(req); device != "[fe80::1]:/share_name/app" {
+		t.Errorf("unexpected device %s", device)
+	}
+	d.server = "bad_host"
+	if err := d.Validate(req); err == nil {
+		t.Error("expected an invalid NFS_SERVER to be rejected")
+	}
+}
+
+func TestValidateServer(t *testing.T) {
+	tests := map[string]bool{
+		"server1":             true,
+		"nfs.example.com":     true,
+		"192.168.1.1":         true,
+		"fe80::1":             true,
+		"[fe80::1]":           true,
+		"server1,server2":     false,
+		"server1, server2":    false,
+		"server1 server2":     false,
+		"server_1":            false,
+		"192.168.1.1,server2": false,
+	}
+	for server, valid := range tests {
+		if err := validateServer(server); (err == nil) != valid {
+			t.Errorf("validateServer(%q) error %v, expected valid %v", server, err, valid)
+		}
+	}
+}
+
+func TestParentMountArgs(t *testing.T) {
+	d := &nfsDriver{}
+	tests := []struct {
+		args     []string
+		expected []string
+		subdir   string
+	}{
+		{[]string{"-t", "nfs", "-o", "hard", "server1:/export/app"}, []string{"-t", "nfs", "-o", "hard", "server1:/export"}, "app"},
+		{[]string{"-t", "nfs", "-o", "hard", "[fe80::1]:/export/app/"}, []string{"-t", "nfs", "-o", "hard", "[fe80::1]:/export"}, "app"},
+		{[]string{"-t", "nfs", "-o", "hard", "server1:/export"}, nil, ""},
+	}
+	for _, test := range tests {
+		parentArgs, subdir := d.ParentMountArgs(test.args)
+		if !reflect.DeepEqual(parentArgs, test.expected) || subdir != test.subdir {
+			t.Errorf("ParentMountArgs(%v) = %v, %s expected %v, %s", test.args, parentArgs, subdir, test.expected, test.subdir)
+		}
+	}
+}
+
+func TestFallbackArgs(t *testing.T) {
+	d := &nfsDriver{versFallback: []string{"4.2", "4.1", "4", "3"}}
+	args := []string{"-t", "nfs", "-o", "hard,proto=tcp", "server1:/export"}
+	output := []byte("mount.nfs: Protocol not supported")
+	candidates := d.FallbackArgs(args, output)
+	expected := [][]string{
+		{"-t", "nfs", "-o", "hard,proto=tcp,nfsvers=4.2", "server1:/export"},
+		{"-t", "nfs", "-o", "hard,proto=tcp,nfsvers=4.1", "server1:/export"},
+		{"-t", "nfs", "-o", "hard,proto=tcp,nfsvers=4", "server1:/export"},
+		{"-t", "nfs", "-o", "hard,proto=tcp,nfsvers=3", "server1:/export"},
+	}
+	if !reflect.DeepEqual(candidates, expected) {
+		t.Errorf("%v didn't match expected %v", candidates, expected)
+	}
+	if args[3] != "hard,proto=tcp" {
+		t.Error("the arguments were modified")
+	}
+
+	candidates = d.FallbackArgs([]string{"-t", "nfs", "-o", "", "server1:/export"}, []byte("mount.nfs: requested NFS version or transport protocol is not supported"))
+	if len(candidates) != 4 || candidates[0][3] != "nfsvers=4.2" {
+		t.Errorf("unexpected candidates %v", candidates)
+	}
+	for _, pinned := range []string{"hard,nfsvers=4", "hard,VERS=3"} {
+		if candidates := d.FallbackArgs([]string{"-t", "nfs", "-o", pinned, "server1:/export"}, output); candidates != nil {
+			t.Errorf("expected no fallback when the version is pinned by %s: %v", pinned, candidates)
+		}
+	}
+	if candidates := d.FallbackArgs(args, []byte("mount.nfs: access denied by server while mounting server1:/export")); candidates != nil {
+		t.Errorf("expected no fallback for other errors: %v", candidates)
+	}
+	d.versFallback = nil
+	if candidates := d.FallbackArgs(args, output); candidates != nil {
+		t.Errorf("expected no fallback when VERS_FALLBACK is not set: %v", candidates)
+	}
+}
+
+func TestVersionPinnedOnFirstMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mount requires root")
+	}
+	dir, err := ioutil.TempDir("", "vers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Only NFS 4.1 is offered by server1, server2 is down.
+	script := filepath.Join(dir, "mount")
+	content := `#!/bin/sh
+echo "$4 $5" >> ` + dir + `/invocations
+case "$4 $5" in
+*nfsvers=4.1\ server1:*)
+  exec mount -t tmpfs tmpfs "$6"
+  ;;
+*server2:*)
+  echo "mount.nfs: Connection refused"
+  exit 32
+  ;;
+esac
+echo "mount.nfs: Protocol not supported"
+exit 32
+`
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	d := &nfsDriver{
+		Driver:         *mountedvolume.NewDriver(script, true, "nfs1", "local"),
+		defaultOptions: "hard",
+		versFallback:   []string{"4.2", "4.1", "4", "3"},
+	}
+	defer d.Close()
+	defer os.Remove("nfs1.db")
+	d.Init(d)
+	invocations := func() string {
+		content, _ := ioutil.ReadFile(filepath.Join(dir, "invocations"))
+		os.Remove(filepath.Join(dir, "invocations"))
+		return string(content)
+	}
+
+	if err := d.Create(&volume.CreateRequest{Name: "plain", Options: map[string]string{"device": "server1:/export"}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := d.Mount(&volume.MountRequest{Name: "plain", ID: "nfs-vers"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Unmount(&volume.UnmountRequest{Name: "plain", ID: "nfs-vers"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := "hard,nfsvers=4.2 server1:/export\nhard,nfsvers=4.1 server1:/export\nhard,nfsvers=4.1 server1:/export\n"
+	if calls := invocations(); calls != expected {
+		t.Errorf("unexpected invocations %q expected %q", calls, expected)
+	}
+	get, err := d.Get(&volume.GetRequest{Name: "plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := get.Volume.Status["args"]; !reflect.DeepEqual(args, []string{"-t", "nfs", "-o", "hard,nfsvers=4.1", "server1:/export"}) {
+		t.Errorf("expected the version to be stored got %v", args)
+	}
+
+	if err := d.Create(&volume.CreateRequest{Name: "down", Options: map[string]string{"device": "server2:/export"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Mount(&volume.MountRequest{Name: "down", ID: "nfs-vers"}); err == nil {
+		t.Error("expected the mount to fail")
+	}
+	if calls := invocations(); calls != "hard,nfsvers=4.2 server2:/export\n" {
+		t.Errorf("expected other errors not to try the next version %q", calls)
+	}
+}
+
+func TestIsKerberos(t *testing.T) {
+	tests := map[string]bool{
+		"hard,sec=krb5":      true,
+		"hard,sec=krb5i":     true,
+		"sec=sys:krb5p":      true,
+		"hard,sec=sys":       false,
+		"hard,proto=tcp":     false,
+		"hard,krb5=sec":      false,
+		"SEC=krb5,nfsvers=4": true,
+	}
+	for options, expected := range tests {
+		list, err := mountedvolume.ParseOptionList(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isKerberos(list) != expected {
+			t.Errorf("isKerberos(%s) expected %v", options, expected)
+		}
+	}
+}
+
+func TestKeytabPrincipals(t *testing.T) {
+	klistOutput := `Keytab name: FILE:/etc/krb5.keytab
+KVNO Principal
+---- --------------------------------------------------------------------------
+   2 host/client.example.com@EXAMPLE.COM
+   2 host/client.example.com@EXAMPLE.COM
+   3 nfs/client.example.com@EXAMPLE.COM
+`
+	principals := keytabPrincipals(klistOutput)
+	expected := []string{"host/client.example.com@EXAMPLE.COM", "nfs/client.example.com@EXAMPLE.COM"}
+	if !reflect.DeepEqual(principals, expected) {
+		t.Errorf("%v didn't match expected %v", principals, expected)
+	}
+	tests := []struct {
+		principals []string
+		expected   string
+	}{
+		{expected, "host/client.example.com@EXAMPLE.COM"},
+		{[]string{"alice@EXAMPLE.COM", "CLIENT$@EXAMPLE.COM"}, "CLIENT$@EXAMPLE.COM"},
+		{[]string{"alice@EXAMPLE.COM", "HTTP/client.example.com@EXAMPLE.COM"}, ""},
+	}
+	for _, test := range tests {
+		if principal := machinePrincipal(test.principals); principal != test.expected {
+			t.Errorf("machinePrincipal(%v) = %s, expected %s", test.principals, principal, test.expected)
+		}
+	}
+}
+
+func TestValidateKerberos(t *testing.T) {
+	d := &nfsDriver{keytab: "/nonexistent/krb5.keytab"}
+	req := &volume.CreateRequest{Name: "sample", Options: map[string]string{"device": "server1:/share_name", "nfsopts": "sec=krb5p"}}
+	if err := d.Validate(req); err == nil || !strings.Contains(err.Error(), "KERBEROS=true") {
+		t.Errorf("expected an error requiring KERBEROS=true: %v", err)
+	}
+	d.kerberos = true
+	if err := d.Validate(req); err == nil || !strings.Contains(err.Error(), "/nonexistent/krb5.keytab") {
+		t.Errorf("expected an error for the missing keytab: %v", err)
+	}
+	if _, err := d.MountEnv(&volume.MountRequest{Name: "sample"}, []string{"-t", "nfs", "-o", "sec=krb5", "server1:/share_name"}); err == nil {
+		t.Error("expected the mount to be rejected")
+	}
+	d.kerberos = false
+	if env, err := d.MountEnv(&volume.MountRequest{Name: "sample"}, []string{"-t", "nfs", "-o", "hard", "server1:/share_name"}); env != nil || err != nil {
+		t.Errorf("expected volumes without sec=krb5 to be mounted as is: %v %v", env, err)
+	}
+}
+
+// fakeShowmount writes a showmount executable that records the servers it
+// is invoked for and lists the exports of server1.
+func fakeShowmount(t *testing.T, dir string) string {
+	script := filepath.Join(dir, "showmount")
+	content := `#!/bin/sh
+echo "$3" >> ` + dir + `/invocations
+case "$3" in
+server1)
+  echo "/srv/share_name 10.0.0.0/24"
+  echo "/srv/other      *"
+  ;;
+slow)
+  exec sleep 5
+  ;;
+unknown)
+  echo "clnt_create: RPC: Unknown host"
+  exit 1
+  ;;
+*)
+  echo "clnt_create: RPC: Program not registered"
+  exit 1
+  ;;
+esac
+`
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+func TestExportCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := &nfsDriver{exports: newExportCache(fakeShowmount(t, dir), 100*time.Millisecond, time.Minute)}
+
+	tests := []struct {
+		device string
+		valid  bool
+	}{
+		{"server1:/srv/share_name", true},
+		{"server1:/srv/share_name/app", true},
+		{"server1:/srv/other/", true},
+		{"server1:/srv/share_nam", false},
+		{"server1:/srv", false},
+		{"server1:/share_name/app", true},
+		{"server1:/share_nam", false},
+		{"server2:/srv/share_name", true},
+		{"slow:/srv/share_name", true},
+		{"unknown:/srv/share_name", false},
+	}
+	for _, test := range tests {
+		err := d.CheckCreate(&volume.CreateRequest{Name: "sample", Options: map[string]string{"device": test.device}})
+		if (err == nil) != test.valid {
+			t.Errorf("CheckCreate(%s) error %v, expected valid %v", test.device, err, test.valid)
+		}
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "invocations"))
+	if calls := strings.Fields(string(content)); !reflect.DeepEqual(calls, []string{"server1", "server2", "slow", "unknown"}) {
+		t.Errorf("expected the export list of server1 to be cached: %v", calls)
+	}
+
+	d.exports.entries["server1"] = exportList{exports: []string{"/srv/share_name"}, fetchedAt: time.Now().Add(-2 * time.Minute)}
+	if err := d.CheckCreate(&volume.CreateRequest{Name: "sample", Options: map[string]string{"device": "server1:/srv/other"}}); err != nil {
+		t.Errorf("expected the expired export list to be refreshed: %v", err)
+	}
+}
+
+func TestParseExports(t *testing.T) {
+	output := "Export list for server1:\n/srv/share_name 10.0.0.0/24\n/     *\n\n"
+	if exports := parseExports(output); !reflect.DeepEqual(exports, []string{"/srv/share_name", "/"}) {
+		t.Errorf("unexpected exports %v", exports)
+	}
+}
+
+func TestParentFallbackArgs(t *testing.T) {
+	d := &nfsDriver{versFallback: []string{"4.1", "3"}}
+	args := []string{"-t", "nfs", "-o", "hard", "server1:/export/app"}
+	parentArgs, _ := d.ParentMountArgs(args)
+	candidates := d.FallbackArgs(args, []byte("mount.nfs: Protocol not supported"))
+	if len(candidates) != 2 {
+		t.Fatalf("unexpected candidates %v", candidates)
+	}
+	// The parent of each candidate is mounted when the subdirectory is
+	// created so it must use the same version.
+	for i, vers := range []string{"4.1", "3"} {
+		candidateParentArgs, subdir := d.ParentMountArgs(candidates[i])
+		expected := []string{"-t", "nfs", "-o", "hard,nfsvers=" + vers, "server1:/export"}
+		if !reflect.DeepEqual(candidateParentArgs, expected) || subdir != "app" {
+			t.Errorf("ParentMountArgs(%v) = %v, %s expected %v", candidates[i], candidateParentArgs, subdir, expected)
+		}
+	}
+	if parentArgs[3] != "hard" {
+		t.Errorf("the parent arguments were modified %v", parentArgs)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/trajano/docker-volume-plugins/mounted-volume"
+)
+
+// versionErrors are the mount.nfs errors that indicate the server did not
+// accept the requested NFS version.
+var versionErrors = []string{
+	"Protocol not supported",
+	"requested NFS version or transport protocol is not supported",
+	"Program not registered",
+}
+
+// versionOptions are the options that pin the NFS version.
+var versionOptions = []string{"vers", "nfsvers"}
+
+// FallbackArgs retries a mount that failed because of the NFS version with
+// each of the versions in VERS_FALLBACK in order.  Volumes whose options
+// already pin the version are not retried.
+func (p *nfsDriver) FallbackArgs(args []string, output []byte) [][]string {
+	if !isVersionError(string(output)) {
+		return nil
+	}
+	return p.CandidateArgs(args)
+}
+
+// CandidateArgs pins the NFS version of volumes whose options do not when
+// they are first mounted by trying each of the versions in VERS_FALLBACK in
+// order.  Without it mount.nfs negotiates the version on every mount so a
+// volume could end up using a different version each time.
+func (p *nfsDriver) CandidateArgs(args []string) [][]string {
+	if len(p.versFallback) == 0 {
+		return nil
+	}
+	optionsIndex := -1
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-o" {
+			optionsIndex = i + 1
+		}
+	}
+	if optionsIndex == -1 {
+		return nil
+	}
+	options, err := mountedvolume.ParseOptionList(args[optionsIndex])
+	if err != nil {
+		return nil
+	}
+	for _, key := range versionOptions {
+		if options.Has(key) {
+			return nil
+		}
+	}
+	var candidates [][]string
+	for _, vers := range p.versFallback {
+		candidate := append([]string{}, args...)
+		if candidate[optionsIndex] == "" {
+			candidate[optionsIndex] = "nfsvers=" + vers
+		} else {
+			candidate[optionsIndex] += ",nfsvers=" + vers
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates
+}
+
+func isVersionError(output string) bool {
+	for _, e := range versionErrors {
+		if strings.Contains(output, e) {
+			return true
+		}
+	}
+	return false
+}
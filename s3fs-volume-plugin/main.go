@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strings"
@@ -16,24 +17,60 @@ type s3fsDriver struct {
 
 func (p *s3fsDriver) Validate(req *volume.CreateRequest) error {
 
+	if _, err := mountedvolume.MergeOptionLists(p.defaultS3fsopts, req.Options["s3fsopts"]); err != nil {
+		return fmt.Errorf("invalid s3fsopts: %s", err)
+	}
+	parts := strings.SplitN(req.Name, "/", 2)
+	if parts[0] == "" {
+		return fmt.Errorf("the volume name %s must start with the bucket", req.Name)
+	}
+	if len(parts) == 2 {
+		if subdir := strings.TrimSuffix(parts[1], "/"); subdir != "" {
+			if err := mountedvolume.ValidateSubdir(subdir); err != nil {
+				return fmt.Errorf("invalid volume name %s: %s", req.Name, err)
+			}
+		}
+	}
 	return nil
 }
 
 func (p *s3fsDriver) MountOptions(req *volume.CreateRequest) []string {
 
-	s3fsopts, s3fsoptsInOpts := req.Options["s3fsopts"]
-
-	var s3fsoptsArray []string
-	if s3fsoptsInOpts {
-		s3fsoptsArray = append(s3fsoptsArray, strings.Split(s3fsopts, ",")...)
-	} else {
-		s3fsoptsArray = append(s3fsoptsArray, strings.Split(p.defaultS3fsopts, ",")...)
-	}
-	s3fsoptsArray = AppendBucketOptionsByVolumeName(s3fsoptsArray, req.Name)
+	// driver_opts.s3fsopts is merged into DEFAULT_S3FSOPTS with the
+	// ownership options taking precedence, the options are checked by
+	// Validate.
+	merged, _ := mountedvolume.MergeOptionLists(p.defaultS3fsopts, req.Options["s3fsopts"], strings.Join(ownershipOptions(req.Options), ","))
+	s3fsoptsArray := AppendBucketOptionsByVolumeName(merged.Strings(), req.Name)
 
 	return []string{"-o", strings.Join(s3fsoptsArray, ",")}
 }
 
+// MapsOwnership indicates that the uid, gid and mode options are passed to
+// s3fs as the ownership of the files is determined by the FUSE client.
+func (p *s3fsDriver) MapsOwnership() bool {
+	return true
+}
+
+// ownershipOptions translates the uid, gid and mode options to their s3fs
+// equivalents.  The mode is converted to a umask.
+func ownershipOptions(options map[string]string) []string {
+	ownership, err := mountedvolume.ParseOwnership(options)
+	if err != nil {
+		return nil
+	}
+	var opts []string
+	if ownership.UID >= 0 {
+		opts = append(opts, fmt.Sprintf("uid=%d", ownership.UID))
+	}
+	if ownership.GID >= 0 {
+		opts = append(opts, fmt.Sprintf("gid=%d", ownership.GID))
+	}
+	if ownership.Mode >= 0 {
+		opts = append(opts, fmt.Sprintf("umask=%04o", 0777&^ownership.Mode))
+	}
+	return opts
+}
+
 func (p *s3fsDriver) PreMount(req *volume.MountRequest) error {
 	return nil
 }
@@ -41,6 +78,30 @@ func (p *s3fsDriver) PreMount(req *volume.MountRequest) error {
 func (p *s3fsDriver) PostMount(req *volume.MountRequest) {
 }
 
+// ParentMountArgs removes the servicepath option so the bucket itself can be
+// mounted to create the subdirectory.
+func (p *s3fsDriver) ParentMountArgs(args []string) ([]string, string) {
+	var parentArgs []string
+	subdir := ""
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-o" && i+1 < len(args) {
+			i++
+			var opts []string
+			for _, opt := range strings.Split(args[i], ",") {
+				if strings.HasPrefix(opt, "servicepath=") {
+					subdir = strings.TrimPrefix(opt, "servicepath=")
+				} else {
+					opts = append(opts, opt)
+				}
+			}
+			parentArgs = append(parentArgs, "-o", strings.Join(opts, ","))
+		} else {
+			parentArgs = append(parentArgs, args[i])
+		}
+	}
+	return parentArgs, strings.Trim(subdir, "/")
+}
+
 // AppendBucketOptionsByVolumeName appends the command line arguments into the current argument list given the volume name
 func AppendBucketOptionsByVolumeName(args []string, volumeName string) []string {
 	parts := strings.SplitN(volumeName, "/", 2)
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
 )
 
 func TestVolumeCalculation(t *testing.T) {
@@ -35,3 +37,60 @@ func TestVolumeCalculationTwoLevels(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestParentMountArgs(t *testing.T) {
+	d := &s3fsDriver{}
+	parentArgs, subdir := d.ParentMountArgs([]string{"-o", "nomultipart,bucket=mybucket,servicepath=/levelone"})
+	if !reflect.DeepEqual(parentArgs, []string{"-o", "nomultipart,bucket=mybucket"}) || subdir != "levelone" {
+		t.Errorf("unexpected %v %s", parentArgs, subdir)
+	}
+}
+
+func TestOwnershipOptions(t *testing.T) {
+	opts := ownershipOptions(map[string]string{"uid": "1000", "mode": "0750"})
+	expected := []string{"uid=1000", "umask=0027"}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Errorf("%v didn't match expected %v", opts, expected)
+	}
+}
+
+func TestMergedMountOptions(t *testing.T) {
+	d := &s3fsDriver{defaultS3fsopts: "use_path_request_style,url=https://s3.example.com,umask=0022"}
+	tests := []struct {
+		options  map[string]string
+		expected []string
+	}{
+		{map[string]string{}, []string{"-o", "use_path_request_style,url=https://s3.example.com,umask=0022,bucket=bucket"}},
+		{map[string]string{"s3fsopts": "url=https://other.example.com"}, []string{"-o", "use_path_request_style,url=https://other.example.com,umask=0022,bucket=bucket"}},
+		{map[string]string{"s3fsopts": "-use_path_request_style,allow_other"}, []string{"-o", "url=https://s3.example.com,umask=0022,allow_other,bucket=bucket"}},
+		{map[string]string{"mode": "750"}, []string{"-o", "use_path_request_style,url=https://s3.example.com,umask=0027,bucket=bucket"}},
+	}
+	for _, test := range tests {
+		args := d.MountOptions(&volume.CreateRequest{Name: "bucket", Options: test.options})
+		if !reflect.DeepEqual(args, test.expected) {
+			t.Errorf("%v: %v didn't match expected %v", test.options, args, test.expected)
+		}
+	}
+	if err := d.Validate(&volume.CreateRequest{Name: "bucket", Options: map[string]string{"s3fsopts": "ro,ro"}}); err == nil {
+		t.Error("expected duplicate options to be rejected")
+	}
+}
+
+func TestValidateVolumeName(t *testing.T) {
+	d := &s3fsDriver{}
+	tests := map[string]bool{
+		"bucket":                 true,
+		"bucket/":                true,
+		"bucket/level1/level2":   true,
+		"bucket/../../var/lib":   false,
+		"bucket/level1/./level2": false,
+		"bucket//level1":         false,
+		"/bucket":                false,
+	}
+	for name, valid := range tests {
+		err := d.Validate(&volume.CreateRequest{Name: name, Options: map[string]string{}})
+		if (err == nil) != valid {
+			t.Errorf("Validate(%s) error %v, expected valid %v", name, err, valid)
+		}
+	}
+}